@@ -0,0 +1,274 @@
+package alertmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+const alertsPath = "/api/v2/alerts"
+
+var severities = map[uint8]string{
+	1: "warning",
+	2: "critical",
+	3: "unknown",
+}
+
+type alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// Sender sends the non-OK check results as alerts to Alertmanager.
+// Active alerts are sent again every resend interval,
+// and resolved when the host or service returns to OK.
+type Sender struct {
+	counters       *shared.Counters // The sent and failed counters are alerts, including the resent and resolved ones
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	queue          chan shared.CheckResult
+	isShuttingDown uintptr
+	config         config.Alertmanager
+	client         *http.Client
+	active         map[string]*alert
+	resolved       map[string]*alert // Resolved alerts not sent yet
+}
+
+func alertKey(checkResult shared.CheckResult) string {
+	return checkResult.Hostname + "/" + checkResult.ServiceName
+}
+
+func newAlert(checkResult shared.CheckResult, startsAt time.Time) *alert {
+	alertName := checkResult.ServiceName
+	if checkResult.Type != "service" {
+		alertName = "host"
+	}
+	severity, ok := severities[checkResult.Code]
+	if !ok {
+		severity = "unknown"
+	}
+
+	a := &alert{
+		Labels: map[string]string{
+			"alertname": alertName,
+			"host":      checkResult.Hostname,
+			"service":   checkResult.ServiceName,
+			"severity":  severity,
+		},
+		Annotations: map[string]string{
+			"summary": checkResult.Output,
+		},
+		StartsAt: startsAt,
+	}
+	if perfData := checkResult.PerfData(); perfData != "" {
+		a.Annotations["perfdata"] = perfData
+	}
+	return a
+}
+
+func (sender *Sender) post(alerts []*alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimRight(sender.config.URL, "/") + alertsPath
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sender.config.Username != "" {
+		req.SetBasicAuth(sender.config.Username, sender.config.Password)
+	}
+
+	resp, err := sender.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Alertmanager returned %s: %s", resp.Status, respBody)
+	}
+	return nil
+}
+
+// send posts the given alerts, along with the pending resolved ones
+func (sender *Sender) send(alerts []*alert) {
+	now := time.Now()
+	for _, a := range alerts {
+		// Alertmanager resolves the alert by itself if it is not sent again in time
+		a.EndsAt = now.Add(3 * sender.config.ResendInterval)
+	}
+	for _, a := range sender.resolved {
+		alerts = append(alerts, a)
+	}
+	if len(alerts) == 0 {
+		return
+	}
+
+	if err := sender.post(alerts); err != nil {
+		sender.logger.Error(err)
+		sender.counters.Add(shared.CounterFailed, len(alerts))
+		return
+	}
+	sender.counters.Add(shared.CounterSent, len(alerts))
+	sender.resolved = map[string]*alert{}
+}
+
+// resolve marks an active alert as resolved, it is sent with the next request
+func (sender *Sender) resolve(key string, a *alert) {
+	a.EndsAt = time.Now()
+	sender.resolved[key+"/"+a.Labels["severity"]] = a
+}
+
+func (sender *Sender) process(checkResult shared.CheckResult) *alert {
+	key := alertKey(checkResult)
+	previous, ok := sender.active[key]
+
+	if checkResult.Code == 0 {
+		if ok {
+			sender.resolve(key, previous)
+			delete(sender.active, key)
+		}
+		return nil
+	}
+
+	a := newAlert(checkResult, time.Now())
+	if ok {
+		if previous.Labels["severity"] == a.Labels["severity"] {
+			a.StartsAt = previous.StartsAt
+		} else {
+			// The severity is a label, so it is a different alert for Alertmanager
+			sender.resolve(key, previous)
+		}
+	}
+	sender.active[key] = a
+	delete(sender.resolved, key+"/"+a.Labels["severity"])
+	return a
+}
+
+func (sender *Sender) resendAll() {
+	alerts := make([]*alert, 0, len(sender.active))
+	for _, a := range sender.active {
+		alerts = append(alerts, a)
+	}
+	sender.send(alerts)
+}
+
+func (sender *Sender) spawnSender() {
+	sender.logger.Info("Spawning alertmanager sender")
+	sender.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(sender.config.ResendInterval)
+		defer func() {
+			ticker.Stop()
+			sender.wg.Done()
+		}()
+		sender.logger.Info("Alertmanager sender started")
+
+		for {
+			select {
+			case checkResult, ok := <-sender.queue:
+				if !ok {
+					sender.send(nil)
+					sender.logger.Info("Alertmanager sender ended")
+					return
+				}
+				alerts := []*alert{}
+				if a := sender.process(checkResult); a != nil {
+					alerts = append(alerts, a)
+				}
+				// Send the alerts already queued in the same request
+				for len(sender.queue) > 0 {
+					if a := sender.process(<-sender.queue); a != nil {
+						alerts = append(alerts, a)
+					}
+				}
+				sender.send(alerts)
+			case <-ticker.C:
+				sender.resendAll()
+			}
+		}
+	}()
+}
+
+func (sender *Sender) Emit(checkResults []shared.CheckResult) error {
+	defer func() {
+		recover()
+	}()
+	for _, checkResult := range checkResults {
+		if sender.config.BlockQueue {
+			sender.queue <- checkResult
+			continue
+		}
+		select {
+		case sender.queue <- checkResult:
+		default:
+			sender.counters.Add(shared.CounterDropped, 1)
+			sender.logger.Warnf("Alertmanager queue is full, dropping %s - %s", checkResult.Hostname, checkResult.ServiceName)
+		}
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the counters of the sender
+func (sender *Sender) Stats() map[string]uint64 {
+	return sender.counters.Snapshot()
+}
+
+func (sender *Sender) String() string {
+	return "alertmanager"
+}
+
+func (sender *Sender) Stop() {
+	if atomic.CompareAndSwapUintptr(&sender.isShuttingDown, 0, 1) {
+		close(sender.queue)
+	}
+}
+
+func (sender *Sender) WaitForShutdown() {
+	sender.wg.Wait()
+}
+
+func (sender *Sender) Start() {
+	sender.spawnSender()
+}
+
+func NewSender(logger *logrus.Logger, _config config.Alertmanager) (*Sender, error) {
+	tlsConfig, err := _config.TLS.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	sender := &Sender{
+		counters:       shared.NewCounters(shared.CounterSent, shared.CounterFailed, shared.CounterDropped),
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		queue:          make(chan shared.CheckResult, _config.QueueSize),
+		isShuttingDown: 0,
+		config:         _config,
+		client: &http.Client{
+			Timeout:   _config.Timeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+		active:   map[string]*alert{},
+		resolved: map[string]*alert{},
+	}
+	return sender, nil
+}
@@ -14,7 +14,8 @@ import (
 	"github.com/MiLk/nmp/config"
 	"github.com/MiLk/nmp/consul"
 	"github.com/MiLk/nmp/fluentd"
-	"github.com/MiLk/nmp/nagios"
+	"github.com/MiLk/nmp/pipeline"
+	"github.com/MiLk/nmp/shared"
 )
 
 func startProfiler() {
@@ -70,33 +71,53 @@ func nmpCommand(cmd *cobra.Command, args []string) {
 	runner := consul.NewRunner(log)
 	workerSet.Add(runner)
 
-	writer, err := nagios.NewWriter(log, _config.CheckResultsDir)
+	stats := shared.NewStatsRegistry()
+	output, outputStages, err := newOutputs(log, _config, stats)
 	if err != nil {
 		log.Fatal(err.Error())
 		return
 	}
-	workerSet.Add(writer)
+	for _, stage := range outputStages {
+		for _, worker := range stage {
+			workerSet.Add(worker)
+		}
+	}
 
-	transformer, err := nagios.NewTransformer(log, writer)
-	if err != nil {
-		log.Fatal(err.Error())
-		return
+	checkerOutput := output
+	if _config.Dedup {
+		checkerOutput, err = pipeline.NewDeduplicator(_config.RefreshInterval, output)
+		if err != nil {
+			log.Fatal(err.Error())
+			return
+		}
 	}
-	workerSet.Add(transformer)
 
-	checker, err := collectd.NewChecker(log, _config.Checks, transformer)
+	if _config.Queue.Enabled() {
+		queue, err := pipeline.NewQueue(log, _config.Queue, checkerOutput)
+		if err != nil {
+			log.Fatal(err.Error())
+			return
+		}
+		workerSet.Add(queue)
+		outputStages = append(outputStages, []nmp.Worker{queue})
+		checkerOutput = queue
+	}
+
+	checker, err := collectd.NewChecker(log, _config.Checks, _config.Clusters, _config.ClockSkew, _config.CheckerWorkers, _config.Buffers.Checker, checkerOutput)
 	if err != nil {
 		log.Fatal(err.Error())
 		return
 	}
 	workerSet.Add(checker)
+	stats.AddStage("checker", "", checker.Dropped)
 
-	collectdTransformer, err := collectd.NewTransformer(log, []string{"collectd"}, checker)
+	collectdTransformer, err := collectd.NewTransformer(log, []string{"collectd"}, _config.ClockSkew, _config.Buffers.Transformer, checker)
 	if err != nil {
 		log.Fatal(err.Error())
 		return
 	}
 	workerSet.Add(collectdTransformer)
+	stats.AddStage("transformer", "", collectdTransformer.Dropped)
 
 	fluentdForwarderInput, err := fluentd.NewForwardInput(log, "0.0.0.0:24224", collectdTransformer)
 	if err != nil {
@@ -112,11 +133,20 @@ func nmpCommand(cmd *cobra.Command, args []string) {
 	}
 	workerSet.Add(fluentdHeartbeatInput)
 
-	signalHandler := nmp.NewSignalHandler(workerSet)
+	// Every stage is stopped once the ones feeding it are,
+	// from the input to the queue, the fan-out and the outputs
+	stopStages := [][]nmp.Worker{{fluentdForwarderInput}, {collectdTransformer}, {checker}}
+	for i := len(outputStages) - 1; i >= 0; i-- {
+		stopStages = append(stopStages, outputStages[i])
+	}
+	signalHandler := nmp.NewSignalHandler(workerSet, stopStages...)
 
 	runner.Start()
-	writer.Start()
-	transformer.Start()
+	for _, stage := range outputStages {
+		for _, worker := range stage {
+			worker.Start()
+		}
+	}
 	checker.Start()
 	collectdTransformer.Start()
 	fluentdForwarderInput.Start()
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp"
+	"github.com/MiLk/nmp/alertmanager"
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/fluentd"
+	"github.com/MiLk/nmp/graphite"
+	"github.com/MiLk/nmp/icinga2"
+	"github.com/MiLk/nmp/nagios"
+	"github.com/MiLk/nmp/nrdp"
+	"github.com/MiLk/nmp/nsca"
+	"github.com/MiLk/nmp/pipeline"
+	"github.com/MiLk/nmp/prometheus"
+	"github.com/MiLk/nmp/shared"
+	"github.com/MiLk/nmp/webhook"
+	"github.com/MiLk/nmp/zabbix"
+)
+
+type writerWorker interface {
+	nmp.Worker
+	shared.Writer
+}
+
+// newOutput creates the workers sending the check results to one output.
+// The workers are returned by stage, in the order the stages must be started.
+func newOutput(log *logrus.Logger, name string, output config.Output, stats *shared.StatsRegistry) (shared.Transformer, [][]nmp.Worker, error) {
+	switch output.Type {
+	case config.OutputNSCA:
+		sender, err := nsca.NewSender(log, output.NSCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sender, [][]nmp.Worker{{sender}}, nil
+	case config.OutputNRDP:
+		sender, err := nrdp.NewSender(log, output.NRDP)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sender, [][]nmp.Worker{{sender}}, nil
+	case config.OutputIcinga2:
+		sender, err := icinga2.NewSender(log, output.Icinga2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sender, [][]nmp.Worker{{sender}}, nil
+	case config.OutputAlertmanager:
+		sender, err := alertmanager.NewSender(log, output.Alertmanager)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sender, [][]nmp.Worker{{sender}}, nil
+	case config.OutputWebhook:
+		sender, err := webhook.NewSender(log, output.Webhook)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sender, [][]nmp.Worker{{sender}}, nil
+	case config.OutputZabbix:
+		sender, err := zabbix.NewSender(log, output.Zabbix)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sender, [][]nmp.Worker{{sender}}, nil
+	case config.OutputFluentd:
+		forwarder, err := fluentd.NewForwardOutput(log, output.Fluentd)
+		if err != nil {
+			return nil, nil, err
+		}
+		return forwarder, [][]nmp.Worker{{forwarder}}, nil
+	case config.OutputGraphite:
+		sender, err := graphite.NewSender(log, output.Graphite)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sender, [][]nmp.Worker{{sender}}, nil
+	case config.OutputPrometheus:
+		exporter, err := prometheus.NewExporter(log, output.Prometheus, stats)
+		if err != nil {
+			return nil, nil, err
+		}
+		return exporter, [][]nmp.Worker{{exporter}}, nil
+	}
+
+	var writer writerWorker
+	var err error
+	checkTemplate := nagios.CheckResultTemplate
+	switch output.Type {
+	case config.OutputCommandFile:
+		writer, err = nagios.NewCommandWriter(log, output.CommandFile)
+		checkTemplate = nagios.ExternalCommandTemplate
+	case config.OutputPerfdata:
+		writer, err = nagios.NewPerfdataWriter(log, output.Perfdata)
+		checkTemplate = nagios.PerfdataTemplate
+	default:
+		var spool *nagios.Writer
+		if spool, err = nagios.NewWriter(log, output.Spool); err == nil {
+			stats.AddStage("spool", name, spool.Dropped)
+			writer = spool
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if output.Template != "" {
+		checkTemplate = output.Template
+	}
+
+	transformer, err := nagios.NewTransformer(log, checkTemplate, writer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return transformer, [][]nmp.Worker{{writer}, {transformer}}, nil
+}
+
+// fanOutDropped returns the number of check results dropped by the fan-out for an output
+func fanOutDropped(fanOut *pipeline.FanOut, name string) func() uint64 {
+	return func() uint64 {
+		return fanOut.Dropped()[name]
+	}
+}
+
+// newOutputs creates the fan-out stage sending the check results to every configured output.
+// The workers are returned by stage, in the order the stages must be started:
+// the writers and the senders, the transformers in front of the writers, then the fan-out.
+func newOutputs(log *logrus.Logger, _config *config.Config, stats *shared.StatsRegistry) (shared.Transformer, [][]nmp.Worker, error) {
+	fanOut, err := pipeline.NewFanOut(log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := make([]string, 0, len(_config.Outputs))
+	for name := range _config.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stages := [][]nmp.Worker{}
+	for _, name := range names {
+		output := _config.Outputs[name]
+		transformer, outputStages, err := newOutput(log, name, output, stats)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reporter, ok := transformer.(shared.StatsReporter); ok {
+			stats.AddOutput(name, string(output.Type), reporter)
+		}
+		for i, workers := range outputStages {
+			if i == len(stages) {
+				stages = append(stages, nil)
+			}
+			stages[i] = append(stages[i], workers...)
+		}
+		if err := fanOut.Add(name, pipeline.NewFilter(output), transformer, output.Buffer); err != nil {
+			return nil, nil, err
+		}
+		stats.AddStage("fanout", name, fanOutDropped(fanOut, name))
+	}
+	return fanOut, append(stages, []nmp.Worker{fanOut}), nil
+}
@@ -3,28 +3,61 @@ package collectd
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/hashicorp/hil"
+	"github.com/hashicorp/hil/ast"
 
 	"github.com/MiLk/nmp/config"
-	"github.com/MiLk/nmp/consul"
+	"github.com/MiLk/nmp/pipeline"
 	"github.com/MiLk/nmp/shared"
 )
 
+// Checker evaluates the records with several workers.
+// The records of a host are always evaluated by the same worker,
+// which keeps their order and owns the state of the host.
 type Checker struct {
 	logger         *logrus.Logger
 	wg             sync.WaitGroup
-	emitterChan    chan CollectdRecord
+	shards         []*checkerShard
 	isShuttingDown uintptr
-	checks         map[string][]shared.CheckerRule
+	checks         map[string][]*compiledRule
+	clusters       map[string][]*clusterRule
+	clockSkew      config.ClockSkew
 	transformer    shared.Transformer
 }
 
-func (checker *Checker) checkThreshold(rule shared.CheckerRule, value string, threshold hil.EvaluationResult, code uint8, hostname string) (*shared.CheckResult, error) {
+// checkerShard is the state of the hosts evaluated by one worker
+type checkerShard struct {
+	id              int
+	buffer          *pipeline.Buffer
+	index           *ruleIndex
+	derived         map[string][]derivedInput
+	value           bytes.Buffer
+	samples         map[string]map[string]derivedSample
+	clockSkewStates map[string]clockSkewState
+	// Last time the states of the hosts gone silent were evicted
+	clockSkewEvicted time.Time
+}
+
+// derivedInput links a collectd plugin to one metric of a derived check
+type derivedInput struct {
+	rule  *compiledRule
+	alias string
+}
+
+type derivedSample struct {
+	value     float64
+	timestamp uint64
+}
+
+func (checker *Checker) checkThreshold(rule shared.CheckerRule, value string, threshold hil.EvaluationResult, code uint8, hostname string, timestamp uint64) (*shared.CheckResult, error) {
 	result, err := rule.Compare(value, threshold)
 	if err != nil {
 		return nil, err
@@ -36,154 +69,258 @@ func (checker *Checker) checkThreshold(rule shared.CheckerRule, value string, th
 			Type:        "service",
 			ServiceName: rule.Name,
 			Output:      rule.Check.FormatOutput(value),
+			Timestamp:   timestamp,
 		}, nil
 	}
 	return nil, nil
 }
 
-func (checker *Checker) checkRecord(record CollectdRecord) ([]shared.CheckResult, error) {
-	results := []shared.CheckResult{}
-	if rules, ok := checker.checks[record.Plugin]; ok {
-		for _, rule := range rules {
-			if rule.Check.PluginInstance != "" && rule.Check.PluginInstance != record.PluginInstance {
-				continue
-			}
-			if rule.Check.Type != "" && rule.Check.Type != record.Type {
-				continue
-			}
-			if rule.Check.TypeInstance != "" && rule.Check.TypeInstance != record.TypeInstance {
-				continue
-			}
+func matchIdentity(pluginInstance, _type, typeInstance string, record CollectdRecord) bool {
+	if pluginInstance != "" && pluginInstance != record.PluginInstance {
+		return false
+	}
+	if _type != "" && _type != record.Type {
+		return false
+	}
+	if typeInstance != "" && typeInstance != record.TypeInstance {
+		return false
+	}
+	return true
+}
 
-			buf := new(bytes.Buffer)
-			err := rule.Check.Value.Execute(buf, record)
-			if err != nil {
-				checker.logger.Error(err)
-				continue
-			}
-			value := buf.String()
+func (checker *Checker) evaluate(rule *compiledRule, t thresholds, hostname string, value string, timestamp uint64) (*shared.CheckResult, error) {
+	result, err := checker.checkLevels(rule.CheckerRule, hostname, value, t.warning, t.critical, t.matchName, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	result.Value = value
+	result.Warning = thresholdString(t.warning)
+	result.Critical = thresholdString(t.critical)
+	return result, nil
+}
 
-			critical := rule.Check.Critical
-			warning := rule.Check.Warning
+func (checker *Checker) checkLevels(rule shared.CheckerRule, hostname string, value string, warning hil.EvaluationResult, critical hil.EvaluationResult, matchName string, timestamp uint64) (*shared.CheckResult, error) {
+	// CRITICAL CHECK
+	result, err := checker.checkThreshold(rule, value, critical, 2, hostname, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		checker.logger.Infof("CRITICAL: %s - %s - %s | %+v | %s %s %s\n", hostname, rule.Name, matchName, result, value, rule.Check.Comparator, critical)
+		return result, nil
+	}
 
-			matchName := "default"
+	// WARNING CHECK
+	result, err = checker.checkThreshold(rule, value, warning, 1, hostname, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		checker.logger.Infof("WARNING: %s - %s - %s | %+v | %s %s %s\n", hostname, rule.Name, matchName, result, value, rule.Check.Comparator, warning)
+		return result, nil
+	}
 
-			// Load meta specific thresholds
-			for pattern, threshold := range rule.Check.MetaThresholds {
-				node := consul.GetNode(record.Host)
-				if node == nil {
-					continue
-				}
+	// SUCCESS
+	return &shared.CheckResult{
+		Code:        0,
+		Hostname:    hostname,
+		Type:        "service",
+		ServiceName: rule.Name,
+		Output:      rule.Check.FormatOutput(value),
+		Timestamp:   timestamp,
+	}, nil
+}
 
-				splitted := strings.SplitN(pattern, ":", 2)
-				v, ok := node.Meta[splitted[0]]
-				if !ok || v != splitted[1] {
-					continue
-				}
+func thresholdString(threshold hil.EvaluationResult) string {
+	if s, ok := threshold.Value.(string); ok {
+		return s
+	}
+	return ""
+}
 
-				matchName = fmt.Sprintf("meta:%s", pattern)
+func (checker *Checker) checkRecord(shard *checkerShard, record CollectdRecord) ([]shared.CheckResult, error) {
+	results := []shared.CheckResult{}
+	if record.Skewed && checker.clockSkew.Action == config.ClockSkewDrop {
+		return results, nil
+	}
+	for _, rule := range shard.index.lookup(record) {
+		shard.value.Reset()
+		err := rule.Check.Value.Execute(&shard.value, record)
+		if err != nil {
+			checker.logger.Error(err)
+			continue
+		}
+		value := shard.value.String()
 
-				critical = threshold.Critical
-				warning = threshold.Warning
-				break
-			}
+		result, err := checker.evaluate(rule, shard.index.resolve(rule, record.Host), record.Host, value, record.Timestamp)
+		if err != nil {
+			checker.logger.Error(err)
+			continue
+		}
+		results = append(results, *result)
+		results = append(results, checker.checkClusters(shard, rule.Name, *result, value, record.Timestamp)...)
+	}
+	results = append(results, checker.checkDerived(shard, record)...)
 
-			// Load host specific thresholds
-			priority := 0
-			for pattern, threshold := range rule.Check.HostThresholds {
-				if threshold.Regexp == nil {
-					continue
-				}
+	if record.Skewed {
+		for i := range results {
+			results[i].Output = fmt.Sprintf("%s [clock skew: %s]", results[i].Output, record.Offset)
+		}
+	}
+	return results, nil
+}
 
-				if threshold.Priority < priority {
-					continue
-				}
+// evaluateExpression computes the value of a derived check once a sample
+// of every metric has been received within the window of the check.
+func (checker *Checker) evaluateExpression(rule *compiledRule, samples map[string]derivedSample) (string, bool, error) {
+	if len(samples) < len(rule.Check.Metrics) {
+		return "", false, nil
+	}
 
-				if !threshold.Regexp.MatchString(record.Host) {
-					continue
-				}
+	newest := uint64(0)
+	for _, sample := range samples {
+		if sample.timestamp > newest {
+			newest = sample.timestamp
+		}
+	}
 
-				matchName = fmt.Sprintf("host:%s", pattern)
+	window := uint64(rule.Check.Window / time.Second)
+	vars := map[string]ast.Variable{}
+	for alias, sample := range samples {
+		if sample.timestamp+window < newest {
+			// Too old to be combined, wait for a fresh sample
+			delete(samples, alias)
+			return "", false, nil
+		}
+		vars[alias] = ast.Variable{Type: ast.TypeFloat, Value: sample.value}
+	}
 
-				priority = threshold.Priority
-				critical = threshold.Critical
-				warning = threshold.Warning
-			}
+	result, err := hil.Eval(rule.Check.Expression, &hil.EvalConfig{
+		GlobalScope: &ast.BasicScope{VarMap: vars},
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if result.Type != hil.TypeString {
+		return "", false, fmt.Errorf("Invalid expression result for rule %s: %+v", rule.Name, result)
+	}
+	return result.Value.(string), true, nil
+}
 
-			// CRITICAL CHECK
-			result, err := checker.checkThreshold(rule, value, critical, 2, record.Host)
-			if err != nil {
-				checker.logger.Error(err)
-				continue
-			}
-			if result != nil {
-				checker.logger.Infof("CRITICAL: %s - %s - %s | %+v | %s %s %s\n", record.Host, rule.Name, matchName, result, value, rule.Check.Comparator, critical)
-				results = append(results, *result)
-				continue
-			}
+func (checker *Checker) checkDerived(shard *checkerShard, record CollectdRecord) []shared.CheckResult {
+	results := []shared.CheckResult{}
+	for _, input := range shard.derived[record.Plugin] {
+		metric := input.rule.Check.Metrics[input.alias]
+		if !matchIdentity(metric.PluginInstance, metric.Type, metric.TypeInstance, record) {
+			continue
+		}
 
-			// WARNING CHECK
-			result, err = checker.checkThreshold(rule, value, warning, 1, record.Host)
-			if err != nil {
-				checker.logger.Error(err)
-				continue
-			}
-			if result != nil {
-				checker.logger.Infof("WARNING: %s - %s - %s | %+v | %s %s %s\n", record.Host, rule.Name, matchName, result, value, rule.Check.Comparator, warning)
-				results = append(results, *result)
-				continue
-			}
+		shard.value.Reset()
+		err := metric.Value.Execute(&shard.value, record)
+		if err != nil {
+			checker.logger.Error(err)
+			continue
+		}
+		sampleValue, err := strconv.ParseFloat(shard.value.String(), 64)
+		if err != nil {
+			checker.logger.Error(err)
+			continue
+		}
 
-			// SUCCESS
-			results = append(results, shared.CheckResult{
-				Code:        0,
-				Hostname:    record.Host,
-				Type:        "service",
-				ServiceName: rule.Name,
-				Output:      rule.Check.FormatOutput(value),
-			})
+		key := fmt.Sprintf("%s/%s", record.Host, input.rule.Name)
+		samples, ok := shard.samples[key]
+		if !ok {
+			samples = map[string]derivedSample{}
+			shard.samples[key] = samples
 		}
+		samples[input.alias] = derivedSample{value: sampleValue, timestamp: record.Timestamp}
+
+		value, ok, err := checker.evaluateExpression(input.rule, samples)
+		if err != nil {
+			checker.logger.Error(err)
+			delete(shard.samples, key)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		delete(shard.samples, key)
+
+		result, err := checker.evaluate(input.rule, shard.index.resolve(input.rule, record.Host), record.Host, value, record.Timestamp)
+		if err != nil {
+			checker.logger.Error(err)
+			continue
+		}
+		results = append(results, *result)
+		results = append(results, checker.checkClusters(shard, input.rule.Name, *result, value, record.Timestamp)...)
 	}
-	return results, nil
+	return results
 }
 
-func (checker *Checker) spawnChecker() {
-	checker.logger.Info("Spawning checker")
+func (checker *Checker) spawnChecker(shard *checkerShard) {
+	checker.logger.Infof("Spawning checker %d", shard.id)
 	checker.wg.Add(1)
 	go func() {
 		defer func() {
 			checker.wg.Done()
 		}()
-		checker.logger.Info("Checker started")
-		for record := range checker.emitterChan {
-			checkResults, err := checker.checkRecord(record)
+		checker.logger.Infof("Checker %d started", shard.id)
+		for item := range shard.buffer.Out() {
+			record := item.(CollectdRecord)
+			checkResults, err := checker.checkRecord(shard, record)
 			if err != nil {
 				checker.logger.Error(err)
 				continue
 			}
+			if result := checker.checkClockSkew(shard, record); result != nil {
+				checkResults = append(checkResults, *result)
+			}
 			if len(checkResults) > 0 {
 				checker.transformer.Emit(checkResults)
 			}
 		}
-		checker.logger.Info("Checker ended")
+		checker.logger.Infof("Checker %d ended", shard.id)
 	}()
 }
 
+// shard returns the worker evaluating the records of a host
+func (checker *Checker) shard(hostname string) *checkerShard {
+	h := fnv.New32a()
+	h.Write([]byte(hostname))
+	return checker.shards[h.Sum32()%uint32(len(checker.shards))]
+}
+
 func (checker *Checker) Emit(record CollectdRecord) error {
-	defer func() {
-		recover()
-	}()
-	checker.emitterChan <- record
+	if !checker.shard(record.Host).buffer.Push(record) {
+		checker.logger.Warnf("Checker is not keeping up, dropping records")
+	}
 	return nil
 }
 
+// Dropped returns the number of records dropped because the buffers were full
+func (checker *Checker) Dropped() uint64 {
+	dropped := uint64(0)
+	for _, shard := range checker.shards {
+		dropped += shard.buffer.Dropped()
+	}
+	return dropped
+}
+
+// recordKey identifies the collectd value list of a record, to coalesce them
+func recordKey(item interface{}) string {
+	record := item.(CollectdRecord)
+	return strings.Join([]string{record.Host, record.Plugin, record.PluginInstance, record.Type, record.TypeInstance}, "/")
+}
+
 func (checker *Checker) String() string {
 	return "checker"
 }
 
 func (checker *Checker) Stop() {
 	if atomic.CompareAndSwapUintptr(&checker.isShuttingDown, 0, 1) {
-		close(checker.emitterChan)
+		for _, shard := range checker.shards {
+			shard.buffer.Close()
+		}
 	}
 }
 
@@ -192,25 +329,76 @@ func (checker *Checker) WaitForShutdown() {
 }
 
 func (checker *Checker) Start() {
-	checker.spawnChecker()
+	for _, shard := range checker.shards {
+		checker.spawnChecker(shard)
+	}
 }
 
-func NewChecker(logger *logrus.Logger, checks map[string]config.Check, transformer shared.Transformer) (*Checker, error) {
-	_checks := map[string][]shared.CheckerRule{}
+// newDerivedInputs compiles the derived checks for one worker. hil.Eval rewrites
+// the expression while evaluating it, so every worker parses its own copy.
+func newDerivedInputs(checks map[string]config.Check) (map[string][]derivedInput, error) {
+	derived := map[string][]derivedInput{}
+	for k, v := range checks {
+		if !v.IsDerived() {
+			continue
+		}
+		expression, err := hil.Parse(v.ExpressionTpl)
+		if err != nil {
+			return nil, err
+		}
+		v.Expression = expression
+		rule := compileRule(k, v)
+		for alias, metric := range v.Metrics {
+			derived[metric.Plugin] = append(derived[metric.Plugin], derivedInput{rule: rule, alias: alias})
+		}
+	}
+	return derived, nil
+}
 
+func NewChecker(logger *logrus.Logger, checks map[string]config.Check, clusters map[string]config.Cluster, clockSkew config.ClockSkew, workers int, buffer config.Buffer, transformer shared.Transformer) (*Checker, error) {
+	_checks := map[string][]*compiledRule{}
 	for k, v := range checks {
-		if _, ok := _checks[v.Plugin]; !ok {
-			_checks[v.Plugin] = []shared.CheckerRule{}
+		if !v.IsDerived() {
+			_checks[v.Plugin] = append(_checks[v.Plugin], compileRule(k, v))
+		}
+	}
+
+	_clusters := map[string][]*clusterRule{}
+	for k, v := range clusters {
+		_clusters[v.CheckName] = append(_clusters[v.CheckName], newClusterRule(k, v))
+	}
+
+	if workers <= 0 {
+		workers = 1
+	}
+	shards := make([]*checkerShard, workers)
+	for i := range shards {
+		shardBuffer, err := pipeline.NewBuffer(buffer, recordKey)
+		if err != nil {
+			return nil, err
+		}
+		derived, err := newDerivedInputs(checks)
+		if err != nil {
+			return nil, err
+		}
+		shards[i] = &checkerShard{
+			id:              i,
+			buffer:          shardBuffer,
+			index:           newRuleIndex(_checks),
+			derived:         derived,
+			samples:         map[string]map[string]derivedSample{},
+			clockSkewStates: map[string]clockSkewState{},
 		}
-		_checks[v.Plugin] = append(_checks[v.Plugin], shared.CheckerRule{Name: k, Check: v})
 	}
 
 	checker := &Checker{
 		logger:         logger,
 		wg:             sync.WaitGroup{},
-		emitterChan:    make(chan CollectdRecord),
+		shards:         shards,
 		isShuttingDown: 0,
 		checks:         _checks,
+		clusters:       _clusters,
+		clockSkew:      clockSkew,
 		transformer:    transformer,
 	}
 	return checker, nil
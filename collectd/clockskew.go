@@ -0,0 +1,67 @@
+package collectd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+// Minimum delay between two identical clock skew results for the same host
+const clockSkewRefresh = 1 * time.Minute
+
+// The states of the hosts which sent no record for this long are evicted
+const clockSkewExpiry = 3 * clockSkewRefresh
+
+type clockSkewState struct {
+	skewed   bool
+	lastEmit time.Time
+}
+
+// checkClockSkew returns the result of the clock skew service of the host
+// when its state changed or when it has not been sent for a while.
+func (checker *Checker) checkClockSkew(shard *checkerShard, record CollectdRecord) *shared.CheckResult {
+	if checker.clockSkew.ServiceName == "" {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Sub(shard.clockSkewEvicted) >= clockSkewRefresh {
+		shard.evictClockSkewStates(now)
+	}
+	state, ok := shard.clockSkewStates[record.Host]
+	if ok && state.skewed == record.Skewed && now.Sub(state.lastEmit) < clockSkewRefresh {
+		return nil
+	}
+	shard.clockSkewStates[record.Host] = clockSkewState{skewed: record.Skewed, lastEmit: now}
+
+	result := &shared.CheckResult{
+		Code:        0,
+		Hostname:    record.Host,
+		Type:        "service",
+		ServiceName: checker.clockSkew.ServiceName,
+		Output:      fmt.Sprintf("Clock offset of %s", record.Offset),
+		Timestamp:   uint64(now.Unix()),
+	}
+	if record.Skewed {
+		result.Code = 2
+		if checker.clockSkew.Action == config.ClockSkewDrop {
+			result.Output = fmt.Sprintf("Clock skew of %s, samples are dropped", record.Offset)
+		} else {
+			result.Output = fmt.Sprintf("Clock skew of %s", record.Offset)
+		}
+	}
+	return result
+}
+
+// evictClockSkewStates forgets the hosts whose state has not been sent for
+// a few refresh intervals, the hosts sending records refresh it every interval.
+func (shard *checkerShard) evictClockSkewStates(now time.Time) {
+	for host, state := range shard.clockSkewStates {
+		if now.Sub(state.lastEmit) >= clockSkewExpiry {
+			delete(shard.clockSkewStates, host)
+		}
+	}
+	shard.clockSkewEvicted = now
+}
@@ -0,0 +1,36 @@
+package collectd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MiLk/nmp/config"
+)
+
+func TestClockSkewStatesOfSilentHostsAreEvicted(t *testing.T) {
+	checker := &Checker{clockSkew: config.ClockSkew{ServiceName: "clock"}}
+	now := time.Now()
+	shard := &checkerShard{clockSkewStates: map[string]clockSkewState{
+		"active": {lastEmit: now.Add(-clockSkewRefresh / 2)},
+		"silent": {lastEmit: now.Add(-clockSkewExpiry)},
+	}}
+
+	if result := checker.checkClockSkew(shard, CollectdRecord{Host: "new"}); result == nil {
+		t.Fatal("expected the clock skew result of the new host")
+	}
+	if _, ok := shard.clockSkewStates["silent"]; ok {
+		t.Error("expected the state of the silent host to be evicted")
+	}
+	for _, host := range []string{"active", "new"} {
+		if _, ok := shard.clockSkewStates[host]; !ok {
+			t.Errorf("expected the state of the host %s to be kept", host)
+		}
+	}
+
+	// The states are not scanned again before the next refresh
+	shard.clockSkewStates["silent"] = clockSkewState{lastEmit: now.Add(-clockSkewExpiry)}
+	checker.checkClockSkew(shard, CollectdRecord{Host: "new"})
+	if _, ok := shard.clockSkewStates["silent"]; !ok {
+		t.Error("expected the states to be evicted once per refresh interval")
+	}
+}
@@ -0,0 +1,161 @@
+package collectd
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/consul"
+	"github.com/MiLk/nmp/shared"
+)
+
+type clusterMember struct {
+	code      uint8
+	value     float64
+	hasValue  bool
+	timestamp uint64
+}
+
+// clusterRule keeps the last evaluation of every host member of a cluster.
+// The members are evaluated by different checker workers.
+type clusterRule struct {
+	mtx       sync.Mutex
+	rule      *compiledRule
+	cluster   config.Cluster
+	metaKey   string
+	metaValue string
+	members   map[string]clusterMember
+}
+
+func newClusterRule(name string, cluster config.Cluster) *clusterRule {
+	c := &clusterRule{
+		rule:    compileRule(name, cluster.Check()),
+		cluster: cluster,
+		members: map[string]clusterMember{},
+	}
+	if splitted := strings.SplitN(cluster.Meta, ":", 2); len(splitted) == 2 {
+		c.metaKey = splitted[0]
+		c.metaValue = splitted[1]
+	}
+	return c
+}
+
+func (c *clusterRule) matchHost(hostname string) bool {
+	if c.cluster.Hosts != nil && !c.cluster.Hosts.MatchString(hostname) {
+		return false
+	}
+
+	if c.cluster.Meta != "" {
+		node := consul.GetNode(hostname)
+		if node == nil {
+			return false
+		}
+
+		v, ok := node.Meta[c.metaKey]
+		if !ok || v != c.metaValue {
+			return false
+		}
+	}
+	return true
+}
+
+// aggregate drops the members which have not been updated within the window
+// and computes the aggregated value of the remaining ones. mtx must be held.
+func (c *clusterRule) aggregate(newest uint64) (float64, int, bool) {
+	window := uint64(c.cluster.Window / time.Second)
+
+	var count, withValue, warning, critical int
+	sum := 0.0
+	min := math.Inf(1)
+	max := math.Inf(-1)
+	for hostname, member := range c.members {
+		if member.timestamp+window < newest {
+			delete(c.members, hostname)
+			continue
+		}
+
+		count++
+		switch member.code {
+		case 1:
+			warning++
+		case 2:
+			critical++
+		}
+
+		if !member.hasValue {
+			continue
+		}
+		withValue++
+		sum += member.value
+		min = math.Min(min, member.value)
+		max = math.Max(max, member.value)
+	}
+
+	if count == 0 {
+		return 0, 0, false
+	}
+
+	switch c.cluster.Aggregate {
+	case config.AggregateCount:
+		return float64(count), count, true
+	case config.AggregatePercentWarning:
+		return 100 * float64(warning) / float64(count), count, true
+	case config.AggregatePercentCritical:
+		return 100 * float64(critical) / float64(count), count, true
+	case config.AggregatePercentNonOK:
+		return 100 * float64(warning+critical) / float64(count), count, true
+	}
+
+	if withValue == 0 {
+		return 0, count, false
+	}
+
+	switch c.cluster.Aggregate {
+	case config.AggregateSum:
+		return sum, count, true
+	case config.AggregateAvg:
+		return sum / float64(withValue), count, true
+	case config.AggregateMin:
+		return min, count, true
+	case config.AggregateMax:
+		return max, count, true
+	}
+	return 0, count, false
+}
+
+// checkClusters records the evaluation of a host for the clusters built on top
+// of the check and returns the updated results of these clusters.
+func (checker *Checker) checkClusters(shard *checkerShard, checkName string, result shared.CheckResult, value string, timestamp uint64) []shared.CheckResult {
+	results := []shared.CheckResult{}
+	for _, c := range checker.clusters[checkName] {
+		if !c.matchHost(result.Hostname) {
+			continue
+		}
+
+		member := clusterMember{code: result.Code, timestamp: timestamp}
+		if valueF, err := strconv.ParseFloat(value, 64); err == nil {
+			member.value = valueF
+			member.hasValue = true
+		}
+		c.mtx.Lock()
+		c.members[result.Hostname] = member
+		aggregated, count, ok := c.aggregate(timestamp)
+		c.mtx.Unlock()
+		if !ok {
+			continue
+		}
+
+		clusterResult, err := checker.evaluate(c.rule, shard.index.resolve(c.rule, c.cluster.Hostname), c.cluster.Hostname, strconv.FormatFloat(aggregated, 'f', -1, 64), timestamp)
+		if err != nil {
+			checker.logger.Error(err)
+			continue
+		}
+		clusterResult.Output = fmt.Sprintf("%s (%d hosts)", clusterResult.Output, count)
+		results = append(results, *clusterResult)
+	}
+	return results
+}
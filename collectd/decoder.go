@@ -0,0 +1,195 @@
+package collectd
+
+import (
+	"sync"
+
+	"github.com/MiLk/nmp/msgpack"
+	"github.com/MiLk/nmp/shared"
+)
+
+// Number of interned strings above which they are forgotten,
+// so a stream of always different values does not grow the memory
+const maxInternedStrings = 10000
+
+// Minimum number of values allocated at once for the records of a stream
+const valuesChunkSize = 1024
+
+// recordBatch holds the records decoded from one forward message
+type recordBatch struct {
+	records []CollectdRecord
+}
+
+var batchPool = sync.Pool{
+	New: func() interface{} {
+		return &recordBatch{}
+	},
+}
+
+// recordStream decodes the collectd records of a connection into the
+// transformer. The strings repeated from a record to another are only
+// allocated once and the records are batched per message.
+type recordStream struct {
+	transformer *Transformer
+	batch       *recordBatch
+	strings     map[string]interface{} // Interned strings, boxed once for the Raw fields
+	lists       map[string]interface{} // Interned []string
+	key         []byte
+	list        []string
+	values      []interface{}
+}
+
+func (stream *recordStream) intern(b []byte) interface{} {
+	if s, ok := stream.strings[string(b)]; ok {
+		return s
+	}
+	if len(stream.strings) >= maxInternedStrings {
+		stream.strings = map[string]interface{}{}
+		stream.lists = map[string]interface{}{}
+	}
+	s := string(b)
+	stream.strings[s] = s
+	return stream.strings[s]
+}
+
+// readString reads a string, and returns it boxed as well for the Raw fields
+func (stream *recordStream) readString(reader *msgpack.Reader) (string, interface{}, error) {
+	b, err := reader.ReadBytes()
+	if err != nil {
+		return "", nil, err
+	}
+	v := stream.intern(b)
+	return v.(string), v, nil
+}
+
+// readList reads an array of strings, such as dsnames and dstypes,
+// which is shared by all the records having the same one
+func (stream *recordStream) readList(reader *msgpack.Reader) (interface{}, error) {
+	n, err := reader.ReadArrayLen()
+	if err != nil {
+		return nil, err
+	}
+
+	stream.key = stream.key[:0]
+	stream.list = stream.list[:0]
+	for i := 0; i < n; i++ {
+		s, _, err := stream.readString(reader)
+		if err != nil {
+			return nil, err
+		}
+		stream.key = append(append(stream.key, s...), 0)
+		stream.list = append(stream.list, s)
+	}
+
+	if list, ok := stream.lists[string(stream.key)]; ok {
+		return list, nil
+	}
+	stream.lists[string(stream.key)] = append([]string(nil), stream.list...)
+	return stream.lists[string(stream.key)], nil
+}
+
+// readValues reads the values of a record. They are allocated by chunks
+// which are never reused, as the records are kept by the checker.
+// A record with more values than a chunk grows it as they are read.
+func (stream *recordStream) readValues(reader *msgpack.Reader) ([]interface{}, error) {
+	n, err := reader.ReadArrayLen()
+	if err != nil {
+		return nil, err
+	}
+
+	if cap(stream.values)-len(stream.values) < n {
+		stream.values = make([]interface{}, 0, valuesChunkSize)
+	}
+	start := len(stream.values)
+	for i := 0; i < n; i++ {
+		v, err := reader.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		stream.values = append(stream.values, v)
+	}
+	return stream.values[start:len(stream.values):len(stream.values)], nil
+}
+
+func (stream *recordStream) Decode(reader *msgpack.Reader, tag string, timestamp uint64) error {
+	if !stream.transformer.tagList[tag] {
+		return reader.Skip()
+	}
+
+	n, err := reader.ReadMapLen()
+	if err != nil {
+		return err
+	}
+
+	record := CollectdRecord{Tag: tag, Timestamp: timestamp, Raw: make(map[string]interface{}, n)}
+	for i := 0; i < n; i++ {
+		key, err := reader.ReadBytes()
+		if err != nil {
+			return err
+		}
+		field := stream.intern(key).(string)
+
+		var value interface{}
+		switch field {
+		case "host":
+			record.Host, value, err = stream.readString(reader)
+		case "plugin":
+			record.Plugin, value, err = stream.readString(reader)
+		case "plugin_instance":
+			record.PluginInstance, value, err = stream.readString(reader)
+		case "type":
+			record.Type, value, err = stream.readString(reader)
+		case "type_instance":
+			record.TypeInstance, value, err = stream.readString(reader)
+		case "values":
+			record.Values, err = stream.readValues(reader)
+			value = record.Values
+		case "dstypes":
+			value, err = stream.readList(reader)
+			record.DsTypes = value
+		case "dsnames":
+			value, err = stream.readList(reader)
+			record.DsNames = value
+		case "interval":
+			var interval float64
+			interval, err = reader.ReadFloat64()
+			record.Interval = uint8(interval)
+			value = interval
+		case "tag":
+			_, value, err = stream.readString(reader)
+		case "meta":
+			value, err = reader.ReadValue()
+		default:
+			if value, err = reader.ReadValue(); err == nil {
+				stream.transformer.logger.Warnf("Unhandled field %s: %+v\n", field, value)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		record.Raw[field] = value
+	}
+
+	stream.batch.records = append(stream.batch.records, record)
+	return nil
+}
+
+func (stream *recordStream) Flush() error {
+	if len(stream.batch.records) == 0 {
+		return nil
+	}
+	if !stream.transformer.buffer.Push(stream.batch) {
+		stream.transformer.logger.Warnf("Transformer is not keeping up, dropping records")
+	}
+	stream.batch = batchPool.Get().(*recordBatch)
+	return nil
+}
+
+// NewRecordStream decodes the records of a connection straight into collectd records
+func (transformer *Transformer) NewRecordStream() shared.RecordStream {
+	return &recordStream{
+		transformer: transformer,
+		batch:       batchPool.Get().(*recordBatch),
+		strings:     map[string]interface{}{},
+		lists:       map[string]interface{}{},
+	}
+}
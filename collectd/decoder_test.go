@@ -0,0 +1,92 @@
+package collectd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ugorji/go/codec"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/msgpack"
+	"github.com/MiLk/nmp/shared"
+)
+
+func newTestTransformer(tb testing.TB) *Transformer {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	transformer, err := NewTransformer(logger, []string{"collectd"}, config.ClockSkew{}, config.Buffer{Size: 10, OverflowPolicy: config.OverflowBlock}, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return transformer
+}
+
+func encode(tb testing.TB, v interface{}) []byte {
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, &codec.MsgpackHandle{}).Encode(v); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func collectdFields(i int) map[string]interface{} {
+	return map[string]interface{}{
+		"host":            fmt.Sprintf("host%d", i%100),
+		"plugin":          "memory",
+		"plugin_instance": "",
+		"type":            "memory",
+		"type_instance":   "free",
+		"values":          []interface{}{1.5, uint64(i)},
+		"dstypes":         []interface{}{"gauge", "gauge"},
+		"dsnames":         []interface{}{"value", "count"},
+		"interval":        10.0,
+		"tag":             "collectd",
+		"meta":            map[string]interface{}{"network:received": true},
+	}
+}
+
+func TestRecordStreamMatchesTransformRecord(t *testing.T) {
+	transformer := newTestTransformer(t)
+	data := encode(t, collectdFields(7))
+
+	stream := transformer.NewRecordStream().(*recordStream)
+	if err := stream.Decode(msgpack.NewReader(bytes.NewReader(data)), "collectd", 42); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.batch.records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(stream.batch.records))
+	}
+	actual := stream.batch.records[0]
+
+	fields, err := msgpack.NewReader(bytes.NewReader(data)).ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected CollectdRecord
+	transformer.TransformRecord("collectd", shared.TinyRecord{Timestamp: 42, Data: fields.(map[string]interface{})}, &expected)
+
+	if actual.Tag != expected.Tag || actual.Timestamp != expected.Timestamp || actual.Host != expected.Host ||
+		actual.Plugin != expected.Plugin || actual.PluginInstance != expected.PluginInstance ||
+		actual.Type != expected.Type || actual.TypeInstance != expected.TypeInstance || actual.Interval != expected.Interval {
+		t.Fatalf("expected %+v, got %+v", expected, actual)
+	}
+	if !reflect.DeepEqual(actual.Values, expected.Values) {
+		t.Fatalf("expected values %#v, got %#v", expected.Values, actual.Values)
+	}
+	// The lists of strings are decoded as []string instead of []interface{}
+	if fmt.Sprint(actual.DsNames) != fmt.Sprint(expected.DsNames) || fmt.Sprint(actual.DsTypes) != fmt.Sprint(expected.DsTypes) {
+		t.Fatalf("expected %v %v, got %v %v", expected.DsNames, expected.DsTypes, actual.DsNames, actual.DsTypes)
+	}
+	if len(actual.Raw) != len(expected.Raw) {
+		t.Fatalf("expected the raw fields %v, got %v", expected.Raw, actual.Raw)
+	}
+	for field, value := range expected.Raw {
+		if fmt.Sprint(actual.Raw[field]) != fmt.Sprint(value) {
+			t.Errorf("expected the raw field %s to be %v, got %v", field, value, actual.Raw[field])
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package collectd
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hil"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/consul"
+	"github.com/MiLk/nmp/shared"
+)
+
+// Number of cached host thresholds above which the cache is reset,
+// to forget the hosts which are gone
+const maxCachedThresholds = 100000
+
+// compiledRule is a check rule with its threshold overrides prepared once,
+// so resolving the thresholds of a host does not parse the patterns again.
+type compiledRule struct {
+	shared.CheckerRule
+	meta  []metaThreshold
+	hosts []hostThreshold
+}
+
+type metaThreshold struct {
+	key       string
+	value     string
+	matchName string
+	warning   hil.EvaluationResult
+	critical  hil.EvaluationResult
+}
+
+type hostThreshold struct {
+	regexp    *regexp.Regexp
+	priority  int
+	matchName string
+	warning   hil.EvaluationResult
+	critical  hil.EvaluationResult
+}
+
+// thresholds are the levels applying to a host for a rule
+type thresholds struct {
+	warning   hil.EvaluationResult
+	critical  hil.EvaluationResult
+	matchName string
+}
+
+// recordIdentity is the part of a record the check rules are selected on
+type recordIdentity struct {
+	plugin         string
+	pluginInstance string
+	_type          string
+	typeInstance   string
+}
+
+type thresholdKey struct {
+	rule     *compiledRule
+	hostname string
+}
+
+// sortedPatterns returns the patterns of a threshold map in a stable order
+func sortedPatterns(m config.CheckThresholdMap) []string {
+	patterns := make([]string, 0, len(m))
+	for pattern := range m {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+func compileRule(name string, check config.Check) *compiledRule {
+	rule := &compiledRule{CheckerRule: shared.CheckerRule{Name: name, Check: check}}
+
+	for _, pattern := range sortedPatterns(check.MetaThresholds) {
+		threshold := check.MetaThresholds[pattern]
+		splitted := strings.SplitN(pattern, ":", 2)
+		if len(splitted) != 2 {
+			continue
+		}
+		rule.meta = append(rule.meta, metaThreshold{
+			key:       splitted[0],
+			value:     splitted[1],
+			matchName: "meta:" + pattern,
+			warning:   threshold.Warning,
+			critical:  threshold.Critical,
+		})
+	}
+
+	for _, pattern := range sortedPatterns(check.HostThresholds) {
+		threshold := check.HostThresholds[pattern]
+		if threshold.Regexp == nil {
+			continue
+		}
+		rule.hosts = append(rule.hosts, hostThreshold{
+			regexp:    threshold.Regexp,
+			priority:  threshold.Priority,
+			matchName: "host:" + pattern,
+			warning:   threshold.Warning,
+			critical:  threshold.Critical,
+		})
+	}
+	return rule
+}
+
+// resolve returns the thresholds of the host. A host pattern overrides a meta one,
+// and the host pattern with the highest priority wins.
+func (rule *compiledRule) resolve(hostname string) thresholds {
+	t := thresholds{
+		warning:   rule.Check.Warning,
+		critical:  rule.Check.Critical,
+		matchName: "default",
+	}
+
+	if len(rule.meta) > 0 {
+		if node := consul.GetNode(hostname); node != nil {
+			for _, meta := range rule.meta {
+				if v, ok := node.Meta[meta.key]; ok && v == meta.value {
+					t = thresholds{warning: meta.warning, critical: meta.critical, matchName: meta.matchName}
+					break
+				}
+			}
+		}
+	}
+
+	priority := 0
+	for _, host := range rule.hosts {
+		if host.priority < priority || !host.regexp.MatchString(hostname) {
+			continue
+		}
+		priority = host.priority
+		t = thresholds{warning: host.warning, critical: host.critical, matchName: host.matchName}
+	}
+	return t
+}
+
+// ruleIndex selects the rules of a record. The rules of a plugin are filtered
+// once per collectd identity and the thresholds once per host, as long as the
+// Consul metadata does not change.
+type ruleIndex struct {
+	rules      map[string][]*compiledRule
+	matches    map[recordIdentity][]*compiledRule
+	thresholds map[thresholdKey]thresholds
+	generation uint64
+}
+
+func newRuleIndex(rules map[string][]*compiledRule) *ruleIndex {
+	return &ruleIndex{
+		rules:      rules,
+		matches:    map[recordIdentity][]*compiledRule{},
+		thresholds: map[thresholdKey]thresholds{},
+		generation: consul.Generation(),
+	}
+}
+
+// lookup returns the rules matching the identity of the record
+func (index *ruleIndex) lookup(record CollectdRecord) []*compiledRule {
+	identity := recordIdentity{
+		plugin:         record.Plugin,
+		pluginInstance: record.PluginInstance,
+		_type:          record.Type,
+		typeInstance:   record.TypeInstance,
+	}
+	if rules, ok := index.matches[identity]; ok {
+		return rules
+	}
+
+	var rules []*compiledRule
+	for _, rule := range index.rules[record.Plugin] {
+		if matchIdentity(rule.Check.PluginInstance, rule.Check.Type, rule.Check.TypeInstance, record) {
+			rules = append(rules, rule)
+		}
+	}
+	index.matches[identity] = rules
+	return rules
+}
+
+// resolve returns the thresholds of the host for the rule
+func (index *ruleIndex) resolve(rule *compiledRule, hostname string) thresholds {
+	if generation := consul.Generation(); generation != index.generation || len(index.thresholds) >= maxCachedThresholds {
+		index.thresholds = map[thresholdKey]thresholds{}
+		index.generation = generation
+	}
+
+	key := thresholdKey{rule: rule, hostname: hostname}
+	if t, ok := index.thresholds[key]; ok {
+		return t
+	}
+	t := rule.resolve(hostname)
+	index.thresholds[key] = t
+	return t
+}
@@ -0,0 +1,210 @@
+package collectd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/hil"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/consul"
+)
+
+func mustParseHIL(tb testing.TB, input string) hil.EvaluationResult {
+	result, err := config.ParseHIL(input, &hil.EvalConfig{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return result
+}
+
+func newThreshold(tb testing.TB, warning, critical string) config.CheckThreshold {
+	return config.CheckThreshold{
+		WarningTpl:  warning,
+		CriticalTpl: critical,
+		Warning:     mustParseHIL(tb, warning),
+		Critical:    mustParseHIL(tb, critical),
+	}
+}
+
+func newHostThreshold(tb testing.TB, pattern string, priority int, warning, critical string) config.CheckThreshold {
+	t := newThreshold(tb, warning, critical)
+	t.Priority = priority
+	t.Regexp = regexp.MustCompile(pattern)
+	return t
+}
+
+// linearRules is how the checker selected the rules of a record before the index
+func linearRules(rules map[string][]*compiledRule, record CollectdRecord) []*compiledRule {
+	var matches []*compiledRule
+	for _, rule := range rules[record.Plugin] {
+		if matchIdentity(rule.Check.PluginInstance, rule.Check.Type, rule.Check.TypeInstance, record) {
+			matches = append(matches, rule)
+		}
+	}
+	return matches
+}
+
+// linearResolve is how the checker resolved the thresholds of a host before the index
+func linearResolve(rule *compiledRule, hostname string) thresholds {
+	t := thresholds{warning: rule.Check.Warning, critical: rule.Check.Critical, matchName: "default"}
+
+	for pattern, threshold := range rule.Check.MetaThresholds {
+		node := consul.GetNode(hostname)
+		if node == nil {
+			continue
+		}
+		splitted := strings.SplitN(pattern, ":", 2)
+		if v, ok := node.Meta[splitted[0]]; !ok || v != splitted[1] {
+			continue
+		}
+		t = thresholds{warning: threshold.Warning, critical: threshold.Critical, matchName: fmt.Sprintf("meta:%s", pattern)}
+		break
+	}
+
+	priority := 0
+	for pattern, threshold := range rule.Check.HostThresholds {
+		if threshold.Regexp == nil || threshold.Priority < priority || !threshold.Regexp.MatchString(hostname) {
+			continue
+		}
+		priority = threshold.Priority
+		t = thresholds{warning: threshold.Warning, critical: threshold.Critical, matchName: fmt.Sprintf("host:%s", pattern)}
+	}
+	return t
+}
+
+// benchmarkRules returns rules with many host and meta thresholds,
+// and records of hosts registered in Consul with a role
+func benchmarkRules(tb testing.TB, prefix string) (map[string][]*compiledRule, []CollectdRecord) {
+	rules := map[string][]*compiledRule{}
+	for i := 0; i < 20; i++ {
+		check := config.Check{
+			Plugin:         "cpu",
+			TypeInstance:   fmt.Sprintf("instance%d", i),
+			Warning:        mustParseHIL(tb, "80"),
+			Critical:       mustParseHIL(tb, "90"),
+			HostThresholds: config.CheckThresholdMap{},
+			MetaThresholds: config.CheckThresholdMap{},
+		}
+		for j := 0; j < 50; j++ {
+			check.HostThresholds[fmt.Sprintf("^%s-web%d-[0-9]+$", prefix, j)] = newHostThreshold(tb, fmt.Sprintf("^%s-web%d-[0-9]+$", prefix, j), j%3, "70", "85")
+		}
+		for j := 0; j < 10; j++ {
+			check.MetaThresholds[fmt.Sprintf("role:role%d", j)] = newThreshold(tb, "60", "75")
+		}
+		rules["cpu"] = append(rules["cpu"], compileRule(fmt.Sprintf("cpu%d", i), check))
+	}
+
+	var records []CollectdRecord
+	for i := 0; i < 1000; i++ {
+		hostname := fmt.Sprintf("%s-web%d-%d", prefix, i%100, i)
+		consul.SetNode(hostname, &api.Node{Node: hostname, Meta: map[string]string{"role": fmt.Sprintf("role%d", i%20)}})
+		records = append(records, CollectdRecord{Host: hostname, Plugin: "cpu", TypeInstance: fmt.Sprintf("instance%d", i%20)})
+	}
+	return rules, records
+}
+
+func TestRuleIndexMatchesLinearScan(t *testing.T) {
+	rules, records := benchmarkRules(t, "match")
+	index := newRuleIndex(rules)
+	for _, record := range records {
+		expected := linearRules(rules, record)
+		actual := index.lookup(record)
+		if len(actual) != len(expected) {
+			t.Fatalf("%s: expected %d rules, got %d", record.Host, len(expected), len(actual))
+		}
+		for i, rule := range actual {
+			if rule != expected[i] {
+				t.Fatalf("%s: expected rule %s, got %s", record.Host, expected[i].Name, rule.Name)
+			}
+			if want, got := linearResolve(rule, record.Host), index.resolve(rule, record.Host); got != want {
+				t.Fatalf("%s: expected %+v, got %+v", record.Host, want, got)
+			}
+		}
+	}
+}
+
+func TestRuleIndexGenerationInvalidatesThresholds(t *testing.T) {
+	rule := compileRule("load", config.Check{
+		Plugin:         "load",
+		Warning:        mustParseHIL(t, "1"),
+		Critical:       mustParseHIL(t, "2"),
+		MetaThresholds: config.CheckThresholdMap{"role:db": newThreshold(t, "4", "8")},
+	})
+	index := newRuleIndex(map[string][]*compiledRule{"load": {rule}})
+
+	const hostname = "generation-db-1"
+	if got := index.resolve(rule, hostname); got.matchName != "default" {
+		t.Fatalf("expected the default thresholds without Consul node, got %s", got.matchName)
+	}
+
+	generation := consul.Generation()
+	consul.SetNode(hostname, &api.Node{Node: hostname, Meta: map[string]string{"role": "db"}})
+	if consul.Generation() == generation {
+		t.Fatal("expected the generation to change with the metadata")
+	}
+	if got := index.resolve(rule, hostname); got.matchName != "meta:role:db" {
+		t.Fatalf("expected the meta thresholds after the generation changed, got %s", got.matchName)
+	}
+
+	// Same metadata, the cached thresholds are kept
+	generation = consul.Generation()
+	consul.SetNode(hostname, &api.Node{Node: hostname, Meta: map[string]string{"role": "db"}})
+	if consul.Generation() != generation {
+		t.Fatal("expected the generation to be kept with the same metadata")
+	}
+	index.thresholds[thresholdKey{rule: rule, hostname: hostname}] = thresholds{matchName: "cached"}
+	if got := index.resolve(rule, hostname); got.matchName != "cached" {
+		t.Fatalf("expected the cached thresholds, got %s", got.matchName)
+	}
+}
+
+func TestRuleIndexResetsFullCache(t *testing.T) {
+	rule := compileRule("load", config.Check{
+		Plugin:   "load",
+		Warning:  mustParseHIL(t, "1"),
+		Critical: mustParseHIL(t, "2"),
+	})
+	index := newRuleIndex(map[string][]*compiledRule{"load": {rule}})
+
+	const hostname = "reset-1"
+	index.thresholds[thresholdKey{rule: rule, hostname: hostname}] = thresholds{matchName: "cached"}
+	for i := len(index.thresholds); i < maxCachedThresholds; i++ {
+		index.thresholds[thresholdKey{rule: rule, hostname: fmt.Sprintf("gone-%d", i)}] = thresholds{}
+	}
+
+	if got := index.resolve(rule, hostname); got.matchName != "default" {
+		t.Fatalf("expected the thresholds to be resolved again, got %s", got.matchName)
+	}
+	if len(index.thresholds) != 1 {
+		t.Fatalf("expected the cache to be reset, got %d entries", len(index.thresholds))
+	}
+}
+
+func BenchmarkCheckRulesLinear(b *testing.B) {
+	rules, records := benchmarkRules(b, "linear")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		record := records[i%len(records)]
+		for _, rule := range linearRules(rules, record) {
+			linearResolve(rule, record.Host)
+		}
+	}
+}
+
+func BenchmarkCheckRulesIndex(b *testing.B) {
+	rules, records := benchmarkRules(b, "index")
+	index := newRuleIndex(rules)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		record := records[i%len(records)]
+		for _, rule := range index.lookup(record) {
+			index.resolve(rule, record.Host)
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package collectd
 
 import (
-	"reflect"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/pipeline"
 	"github.com/MiLk/nmp/shared"
 )
 
@@ -14,18 +16,18 @@ type Transformer struct {
 	logger         *logrus.Logger
 	listener       CollectdCheckerListener
 	wg             sync.WaitGroup
-	emitterChan    chan shared.RecordSet
+	buffer         *pipeline.Buffer
 	isShuttingDown uintptr
 	tagList        TagList
+	clockSkew      config.ClockSkew
 }
 
 func (transformer *Transformer) TransformRecord(tag string, record shared.TinyRecord, transformed *CollectdRecord) error {
-	p := reflect.ValueOf(transformed).Elem()
-	p.Set(reflect.Zero(p.Type()))
-
-	transformed.Tag = tag
-	transformed.Timestamp = record.Timestamp
-	transformed.Raw = record.Data
+	*transformed = CollectdRecord{
+		Tag:       tag,
+		Timestamp: record.Timestamp,
+		Raw:       record.Data,
+	}
 
 	for k, v := range record.Data {
 		switch k {
@@ -58,6 +60,18 @@ func (transformer *Transformer) TransformRecord(tag string, record shared.TinyRe
 	return nil
 }
 
+// emit checks the clock of the record and sends it to the checker
+func (transformer *Transformer) emit(record CollectdRecord) {
+	record.Offset = time.Unix(int64(record.Timestamp), 0).Sub(time.Now()).Round(time.Second)
+	record.Skewed = transformer.clockSkew.IsSkewed(record.Offset)
+	if record.Skewed && transformer.clockSkew.Action == config.ClockSkewDrop && transformer.clockSkew.ServiceName == "" {
+		transformer.logger.Debugf("Dropping record from %s with a clock skew of %s", record.Host, record.Offset)
+		return
+	}
+
+	transformer.listener.Emit(record)
+}
+
 func (transformer *Transformer) spawnTransformer() {
 	transformer.logger.Info("Spawning transformer")
 	transformer.wg.Add(1)
@@ -68,10 +82,20 @@ func (transformer *Transformer) spawnTransformer() {
 		transformer.logger.Info("Transformer started")
 
 		transformed := CollectdRecord{}
-		for recordSet := range transformer.emitterChan {
-			for _, record := range recordSet.Records {
-				transformer.TransformRecord(recordSet.Tag, record, &transformed)
-				transformer.listener.Emit(transformed)
+		for item := range transformer.buffer.Out() {
+			switch batch := item.(type) {
+			case shared.RecordSet:
+				for _, record := range batch.Records {
+					transformer.TransformRecord(batch.Tag, record, &transformed)
+					transformer.emit(transformed)
+				}
+			case *recordBatch:
+				for i := range batch.records {
+					transformer.emit(batch.records[i])
+					batch.records[i] = CollectdRecord{}
+				}
+				batch.records = batch.records[:0]
+				batchPool.Put(batch)
 			}
 		}
 		transformer.logger.Info("Transformer ended")
@@ -79,24 +103,26 @@ func (transformer *Transformer) spawnTransformer() {
 }
 
 func (transformer *Transformer) Emit(recordSets []shared.RecordSet) error {
-	defer func() {
-		recover()
-	}()
 	for _, recordSet := range recordSets {
-		if transformer.tagList[recordSet.Tag] {
-			transformer.emitterChan <- recordSet
+		if transformer.tagList[recordSet.Tag] && !transformer.buffer.Push(recordSet) {
+			transformer.logger.Warnf("Transformer is not keeping up, dropping records")
 		}
 	}
 	return nil
 }
 
+// Dropped returns the number of messages dropped because the buffer was full
+func (transformer *Transformer) Dropped() uint64 {
+	return transformer.buffer.Dropped()
+}
+
 func (transformer *Transformer) String() string {
 	return "transformer"
 }
 
 func (transformer *Transformer) Stop() {
 	if atomic.CompareAndSwapUintptr(&transformer.isShuttingDown, 0, 1) {
-		close(transformer.emitterChan)
+		transformer.buffer.Close()
 	}
 }
 
@@ -108,20 +134,26 @@ func (transformer *Transformer) Start() {
 	transformer.spawnTransformer()
 }
 
-func NewTransformer(logger *logrus.Logger, tagList []string, listener CollectdCheckerListener) (*Transformer, error) {
+func NewTransformer(logger *logrus.Logger, tagList []string, clockSkew config.ClockSkew, buffer config.Buffer, listener CollectdCheckerListener) (*Transformer, error) {
 
 	_tagList := TagList{}
 	for _, _tag := range tagList {
 		_tagList[_tag] = true
 	}
 
+	recordBuffer, err := pipeline.NewBuffer(buffer, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	transformer := &Transformer{
 		logger:         logger,
 		listener:       listener,
 		wg:             sync.WaitGroup{},
-		emitterChan:    make(chan shared.RecordSet),
+		buffer:         recordBuffer,
 		isShuttingDown: 0,
 		tagList:        _tagList,
+		clockSkew:      clockSkew,
 	}
 	return transformer, nil
 }
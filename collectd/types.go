@@ -1,11 +1,13 @@
 package collectd
 
+import "time"
+
 type TagList map[string]bool
 
 type CollectdRecord struct {
 	Tag            string
 	Timestamp      uint64
-	Raw            map[string]interface{}
+	Raw            map[string]interface{} // All the fields of the record
 	Host           string
 	Plugin         string
 	PluginInstance string
@@ -15,6 +17,8 @@ type CollectdRecord struct {
 	DsTypes        interface{}
 	DsNames        interface{}
 	Interval       uint8
+	Offset         time.Duration // Offset of the sample timestamp relative to the time it has been received
+	Skewed         bool          // Whether the offset is outside of the configured clock skew limits
 }
 
 type CollectdCheckerListener interface {
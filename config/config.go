@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/hashicorp/hcl"
 	"github.com/hashicorp/hil"
+	"github.com/hashicorp/hil/ast"
 )
 
 type Comparator string
@@ -61,6 +65,39 @@ func (m CheckThresholdMap) CompileRegexp() error {
 	return nil
 }
 
+// CheckMetric selects one collectd identity used as an input of a derived check.
+type CheckMetric struct {
+	Plugin         string             `hcl:"plugin"`
+	PluginInstance string             `hcl:"plugin_instance"`
+	Type           string             `hcl:"type"`
+	TypeInstance   string             `hcl:"type_instance"`
+	ValueTpl       string             `hcl:"value"`
+	Value          *template.Template `hcl:"-"`
+}
+
+type CheckMetricMap map[string]CheckMetric
+
+func (m CheckMetricMap) Parse(checkName string) error {
+	for alias, metric := range m {
+		if metric.Plugin == "" {
+			return fmt.Errorf("Missing plugin for metric %s of check %s", alias, checkName)
+		}
+
+		if metric.ValueTpl == "" {
+			metric.ValueTpl = "{{ (index .Values 0) }}"
+		}
+
+		t, err := template.New(fmt.Sprintf("%s.%s", checkName, alias)).Parse(metric.ValueTpl)
+		if err != nil {
+			return err
+		}
+		metric.Value = t
+
+		m[alias] = metric
+	}
+	return nil
+}
+
 type Check struct {
 	Plugin         string               `hcl:"plugin"`
 	PluginInstance string               `hcl:"plugin_instance"`
@@ -76,6 +113,17 @@ type Check struct {
 	HostThresholds CheckThresholdMap    `hcl:"host"`
 	MetaThresholds CheckThresholdMap    `hcl:"meta"`
 	Humanize       string               `hcl:"humanize"`
+	Metrics        CheckMetricMap       `hcl:"metric"`
+	ExpressionTpl  string               `hcl:"expression"`
+	Expression     ast.Node             `hcl:"-"`
+	WindowTpl      string               `hcl:"window"`
+	Window         time.Duration        `hcl:"-"`
+}
+
+// IsDerived returns true when the check combines several metrics
+// through an expression instead of reading a single collectd record.
+func (c *Check) IsDerived() bool {
+	return len(c.Metrics) > 0
 }
 
 func (c *Check) FormatOutput(value string) string {
@@ -97,9 +145,197 @@ func (c *Check) FormatOutput(value string) string {
 	return value
 }
 
+type Aggregate string
+
+const (
+	AggregateCount           Aggregate = "count"
+	AggregateSum             Aggregate = "sum"
+	AggregateAvg             Aggregate = "avg"
+	AggregateMin             Aggregate = "min"
+	AggregateMax             Aggregate = "max"
+	AggregatePercentWarning  Aggregate = "percent_warning"
+	AggregatePercentCritical Aggregate = "percent_critical"
+	AggregatePercentNonOK    Aggregate = "percent_non_ok"
+)
+
+// Cluster aggregates the results of a check across several hosts
+// and reports them for a virtual host.
+type Cluster struct {
+	CheckName   string               `hcl:"check"`
+	Hostname    string               `hcl:"hostname"`
+	HostsTpl    string               `hcl:"hosts"`
+	Hosts       *regexp.Regexp       `hcl:"-"`
+	Meta        string               `hcl:"meta"`
+	Aggregate   Aggregate            `hcl:"aggregate"`
+	Comparator  Comparator           `hcl:"comparator"`
+	WarningTpl  string               `hcl:"warning"`
+	CriticalTpl string               `hcl:"critical"`
+	Warning     hil.EvaluationResult `hcl:"-"`
+	Critical    hil.EvaluationResult `hcl:"-"`
+	WindowTpl   string               `hcl:"window"`
+	Window      time.Duration        `hcl:"-"`
+	Humanize    string               `hcl:"humanize"`
+}
+
+// Check returns the check used to compare the aggregated value to the thresholds
+func (c *Cluster) Check() Check {
+	return Check{
+		Comparator: c.Comparator,
+		Warning:    c.Warning,
+		Critical:   c.Critical,
+		Humanize:   c.Humanize,
+	}
+}
+
+func (c *Cluster) Parse(name string, checks map[string]Check, hilConfig *hil.EvalConfig) (err error) {
+	if _, ok := checks[c.CheckName]; !ok {
+		return fmt.Errorf("Unknown check %q for cluster %s", c.CheckName, name)
+	}
+
+	if c.Hostname == "" {
+		return fmt.Errorf("Missing hostname for cluster %s", name)
+	}
+
+	switch c.Aggregate {
+	case "":
+		c.Aggregate = AggregatePercentCritical
+	case AggregateCount, AggregateSum, AggregateAvg, AggregateMin, AggregateMax,
+		AggregatePercentWarning, AggregatePercentCritical, AggregatePercentNonOK:
+	default:
+		return fmt.Errorf("Invalid aggregate %q for cluster %s", c.Aggregate, name)
+	}
+
+	if c.Meta != "" && !strings.Contains(c.Meta, ":") {
+		return fmt.Errorf("Invalid meta selector %q for cluster %s", c.Meta, name)
+	}
+
+	if c.HostsTpl != "" {
+		c.Hosts, err = regexp.Compile(c.HostsTpl)
+		if err != nil {
+			return
+		}
+	}
+
+	if c.Comparator == "" {
+		c.Comparator = GreaterThanOrEqualTo
+	}
+
+	c.Window, err = parseDuration(c.WindowTpl, "5m")
+	if err != nil {
+		return
+	}
+
+	c.Critical, err = ParseHIL(c.CriticalTpl, hilConfig)
+	if err != nil {
+		return
+	}
+	c.Warning, err = ParseHIL(c.WarningTpl, hilConfig)
+	return
+}
+
+type ClockSkewAction string
+
+const (
+	ClockSkewDrop ClockSkewAction = "drop"
+	ClockSkewTag  ClockSkewAction = "tag"
+)
+
+// ClockSkew configures how samples too old or from the future are handled.
+// A zero duration disables the corresponding limit.
+type ClockSkew struct {
+	MaxAgeTpl        string          `hcl:"max_age"`
+	MaxAge           time.Duration   `hcl:"-"`
+	MaxFutureSkewTpl string          `hcl:"max_future_skew"`
+	MaxFutureSkew    time.Duration   `hcl:"-"`
+	Action           ClockSkewAction `hcl:"action"`
+	ServiceName      string          `hcl:"service"`
+}
+
+func (c *ClockSkew) Parse() (err error) {
+	switch c.Action {
+	case "":
+		c.Action = ClockSkewDrop
+	case ClockSkewDrop, ClockSkewTag:
+	default:
+		return fmt.Errorf("Invalid clock_skew action %q", c.Action)
+	}
+
+	if c.MaxAge, err = parseDuration(c.MaxAgeTpl, "0s"); err != nil {
+		return
+	}
+	c.MaxFutureSkew, err = parseDuration(c.MaxFutureSkewTpl, "0s")
+	return
+}
+
+// IsSkewed returns true when the offset of a sample, relative to the time
+// it has been received, is outside of the configured limits.
+func (c *ClockSkew) IsSkewed(offset time.Duration) bool {
+	if c.MaxAge > 0 && -offset > c.MaxAge {
+		return true
+	}
+	if c.MaxFutureSkew > 0 && offset > c.MaxFutureSkew {
+		return true
+	}
+	return false
+}
+
+// Queue configures the persistent queue between the checker and the outputs.
+// The queue is disabled when dir is empty.
+type Queue struct {
+	Dir            string        `hcl:"dir"`
+	SegmentSizeTpl string        `hcl:"segment_size"`
+	SegmentSize    int64         `hcl:"-"`
+	MaxSizeTpl     string        `hcl:"max_size"`
+	MaxSize        int64         `hcl:"-"`
+	RetentionTpl   string        `hcl:"retention"`
+	Retention      time.Duration `hcl:"-"`
+	Sync           bool          `hcl:"sync"`
+}
+
+func (c *Queue) Enabled() bool {
+	return c.Dir != ""
+}
+
+func (c *Queue) Parse() (err error) {
+	if c.SegmentSizeTpl == "" {
+		c.SegmentSizeTpl = "64MB"
+	}
+	size, err := humanize.ParseBytes(c.SegmentSizeTpl)
+	if err != nil {
+		return fmt.Errorf("Invalid queue segment_size: %s", err)
+	}
+	c.SegmentSize = int64(size)
+
+	if c.MaxSizeTpl != "" {
+		size, err := humanize.ParseBytes(c.MaxSizeTpl)
+		if err != nil {
+			return fmt.Errorf("Invalid queue max_size: %s", err)
+		}
+		c.MaxSize = int64(size)
+	}
+
+	c.Retention, err = parseDuration(c.RetentionTpl, "24h")
+	return
+}
+
+// Buffers configures the queues in front of the stages processing the collectd records
+type Buffers struct {
+	Transformer Buffer `hcl:"transformer"`
+	Checker     Buffer `hcl:"checker"`
+}
+
 type Config struct {
-	CheckResultsDir string           `hcl:"check_results_dir"`
-	Checks          map[string]Check `hcl:"check"`
+	CheckResultsDir    string             `hcl:"check_results_dir"`
+	Outputs            map[string]Output  `hcl:"output"`
+	Dedup              bool               `hcl:"dedup"`
+	RefreshIntervalTpl string             `hcl:"refresh_interval"`
+	RefreshInterval    time.Duration      `hcl:"-"`
+	ClockSkew          ClockSkew          `hcl:"clock_skew"`
+	Queue              Queue              `hcl:"queue"`
+	Buffers            Buffers            `hcl:"buffers"`
+	CheckerWorkers     int                `hcl:"checker_workers"`
+	Checks             map[string]Check   `hcl:"check"`
+	Clusters           map[string]Cluster `hcl:"cluster"`
 }
 
 func Read(configFile string) (*Config, error) {
@@ -110,6 +346,14 @@ func Read(configFile string) (*Config, error) {
 	return out, nil
 }
 
+// parseDuration parses the duration tpl, or defaultTpl when tpl is empty
+func parseDuration(tpl string, defaultTpl string) (time.Duration, error) {
+	if tpl == "" {
+		tpl = defaultTpl
+	}
+	return time.ParseDuration(tpl)
+}
+
 func ParseHIL(input string, hilConfig *hil.EvalConfig) (hil.EvaluationResult, error) {
 	tree, err := hil.Parse(input)
 	if err != nil {
@@ -133,6 +377,59 @@ func loadFileHcl(root string) (*Config, error) {
 		return nil, fmt.Errorf("Error decoding %s: %s", root, err)
 	}
 
+	// Without output block, check results are written to check_results_dir
+	if len(out.Outputs) == 0 {
+		out.Outputs = map[string]Output{"spool": {Type: OutputSpool}}
+	}
+	for name, output := range out.Outputs {
+		if err := output.Parse(name, out.CheckResultsDir); err != nil {
+			return nil, err
+		}
+		out.Outputs[name] = output
+	}
+
+	out.RefreshInterval, err = parseDuration(out.RefreshIntervalTpl, "5m")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid refresh_interval: %s", err)
+	}
+
+	if err := out.ClockSkew.Parse(); err != nil {
+		return nil, err
+	}
+
+	if err := out.Queue.Parse(); err != nil {
+		return nil, err
+	}
+	// The queue forwards a batch once the outputs have accepted it,
+	// their buffers and the queues of the senders must not drop the check results instead
+	if out.Queue.Enabled() {
+		for name, output := range out.Outputs {
+			switch output.BufferPolicy {
+			case "":
+				output.Buffer.OverflowPolicy = OverflowBlock
+			case OverflowBlock:
+			default:
+				return nil, fmt.Errorf("Invalid buffer_policy %q for output %s, it must be %q with the queue", output.BufferPolicy, name, OverflowBlock)
+			}
+			output.blockQueues()
+			out.Outputs[name] = output
+		}
+	}
+
+	if out.CheckerWorkers <= 0 {
+		out.CheckerWorkers = runtime.NumCPU()
+	}
+
+	if err := out.Buffers.Transformer.Parse("the transformer", 1000, OverflowBlock); err != nil {
+		return nil, err
+	}
+	if out.Buffers.Transformer.OverflowPolicy == OverflowCoalesce {
+		return nil, fmt.Errorf("Invalid overflow policy %q for the transformer, its messages cannot be coalesced", OverflowCoalesce)
+	}
+	if err := out.Buffers.Checker.Parse("the checker", 1000, OverflowBlock); err != nil {
+		return nil, err
+	}
+
 	hilConfig := &hil.EvalConfig{}
 
 	for name, check := range out.Checks {
@@ -140,13 +437,32 @@ func loadFileHcl(root string) (*Config, error) {
 			check.Comparator = GreaterThanOrEqualTo
 		}
 
-		if check.ValueTpl == "" {
-			check.ValueTpl = "{{ (index .Values 0) }}"
-		}
+		if check.IsDerived() {
+			if err := check.Metrics.Parse(name); err != nil {
+				return nil, err
+			}
 
-		check.Value, err = template.New(name).Parse(check.ValueTpl)
-		if err != nil {
-			return nil, err
+			if check.ExpressionTpl == "" {
+				return nil, fmt.Errorf("Missing expression for derived check %s", name)
+			}
+			check.Expression, err = hil.Parse(check.ExpressionTpl)
+			if err != nil {
+				return nil, err
+			}
+
+			check.Window, err = parseDuration(check.WindowTpl, "1m")
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			if check.ValueTpl == "" {
+				check.ValueTpl = "{{ (index .Values 0) }}"
+			}
+
+			check.Value, err = template.New(name).Parse(check.ValueTpl)
+			if err != nil {
+				return nil, err
+			}
 		}
 		check.Critical, err = ParseHIL(check.CriticalTpl, hilConfig)
 		if err != nil {
@@ -166,5 +482,12 @@ func loadFileHcl(root string) (*Config, error) {
 		out.Checks[name] = check
 	}
 
+	for name, cluster := range out.Clusters {
+		if err := cluster.Parse(name, out.Checks, hilConfig); err != nil {
+			return nil, err
+		}
+		out.Clusters[name] = cluster
+	}
+
 	return &out, nil
 }
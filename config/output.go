@@ -0,0 +1,745 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+type OutputType string
+
+const (
+	OutputSpool        OutputType = "spool"
+	OutputCommandFile  OutputType = "command_file"
+	OutputNSCA         OutputType = "nsca"
+	OutputNRDP         OutputType = "nrdp"
+	OutputIcinga2      OutputType = "icinga2"
+	OutputPrometheus   OutputType = "prometheus"
+	OutputAlertmanager OutputType = "alertmanager"
+	OutputWebhook      OutputType = "webhook"
+	OutputZabbix       OutputType = "zabbix"
+	OutputFluentd      OutputType = "fluentd"
+	OutputGraphite     OutputType = "graphite"
+	OutputPerfdata     OutputType = "perfdata"
+)
+
+// Output configures one of the destinations of the check results.
+// The settings specific to each type are flattened in the output block.
+type Output struct {
+	Type         OutputType     `hcl:"type"`
+	HostsTpl     string         `hcl:"hosts"`
+	Hosts        *regexp.Regexp `hcl:"-"`
+	ServicesTpl  string         `hcl:"services"`
+	Services     *regexp.Regexp `hcl:"-"`
+	Codes        []int          `hcl:"codes"`
+	BufferSize   int            `hcl:"buffer_size"`
+	BufferPolicy OverflowPolicy `hcl:"buffer_policy"`
+	Buffer       Buffer         `hcl:"-"`
+	Template     string         `hcl:"template"`
+	TemplateFile string         `hcl:"template_file"`
+	CommandFile  string         `hcl:"command_file"`
+	Spool        `hcl:",squash"`
+	NSCA         `hcl:",squash"`
+	NRDP         `hcl:",squash"`
+	Icinga2      `hcl:",squash"`
+	Prometheus   `hcl:",squash"`
+	Alertmanager `hcl:",squash"`
+	Webhook      `hcl:",squash"`
+	Zabbix       `hcl:",squash"`
+	Fluentd      `hcl:",squash"`
+	Graphite     `hcl:",squash"`
+	Perfdata     `hcl:",squash"`
+	TLS          `hcl:",squash"`
+}
+
+// blockQueues makes the senders wait for room in their queue
+// instead of dropping the check results
+func (o *Output) blockQueues() {
+	o.NSCA.BlockQueue = true
+	o.NRDP.BlockQueue = true
+	o.Icinga2.BlockQueue = true
+	o.Alertmanager.BlockQueue = true
+	o.Webhook.BlockQueue = true
+	o.Zabbix.BlockQueue = true
+	o.Fluentd.BlockQueue = true
+}
+
+func (o *Output) Parse(name string, checkResultsDir string) (err error) {
+	if o.HostsTpl != "" {
+		if o.Hosts, err = regexp.Compile(o.HostsTpl); err != nil {
+			return
+		}
+	}
+	if o.ServicesTpl != "" {
+		if o.Services, err = regexp.Compile(o.ServicesTpl); err != nil {
+			return
+		}
+	}
+	for _, code := range o.Codes {
+		if code < 0 || code > 3 {
+			return fmt.Errorf("Invalid code %d for output %s", code, name)
+		}
+	}
+	o.Buffer = Buffer{Size: o.BufferSize, OverflowPolicy: o.BufferPolicy}
+	if err := o.Buffer.Parse("output "+name, 10000, OverflowDropNewest); err != nil {
+		return err
+	}
+	o.NRDP.TLS = o.TLS
+	o.Icinga2.TLS = o.TLS
+	o.Alertmanager.TLS = o.TLS
+
+	if o.TemplateFile != "" {
+		if o.Template != "" {
+			return fmt.Errorf("Both template and template_file are set for output %s", name)
+		}
+		content, err := ioutil.ReadFile(o.TemplateFile)
+		if err != nil {
+			return fmt.Errorf("Error reading %s: %s", o.TemplateFile, err)
+		}
+		o.Template = string(content)
+	}
+	o.Webhook.Template = o.Template
+	o.Webhook.TLS = o.TLS
+
+	switch o.Type {
+	case "", OutputSpool:
+		o.Type = OutputSpool
+		if o.CheckResultsDir == "" {
+			o.CheckResultsDir = checkResultsDir
+		}
+		return o.Spool.Parse(name)
+	case OutputCommandFile:
+		if o.CommandFile == "" {
+			return fmt.Errorf("Missing command_file for output %s", name)
+		}
+	case OutputNSCA:
+		return o.NSCA.Parse()
+	case OutputNRDP:
+		return o.NRDP.Parse()
+	case OutputIcinga2:
+		return o.Icinga2.Parse()
+	case OutputPrometheus:
+		return o.Prometheus.Parse()
+	case OutputAlertmanager:
+		return o.Alertmanager.Parse()
+	case OutputWebhook:
+		return o.Webhook.Parse()
+	case OutputZabbix:
+		return o.Zabbix.Parse()
+	case OutputFluentd:
+		return o.Fluentd.Parse()
+	case OutputGraphite:
+		return o.Graphite.Parse()
+	case OutputPerfdata:
+		return o.Perfdata.Parse()
+	default:
+		return fmt.Errorf("Invalid type %q for output %s", o.Type, name)
+	}
+	return
+}
+
+type OverflowPolicy string
+
+const (
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	OverflowCoalesce   OverflowPolicy = "coalesce"
+	OverflowBlock      OverflowPolicy = "block"
+)
+
+// Buffer configures the queue in front of a stage of the pipeline
+type Buffer struct {
+	Size           int            `hcl:"size"`
+	OverflowPolicy OverflowPolicy `hcl:"overflow_policy"`
+}
+
+func (c *Buffer) Parse(stage string, defaultSize int, defaultPolicy OverflowPolicy) error {
+	if c.Size <= 0 {
+		c.Size = defaultSize
+	}
+	switch c.OverflowPolicy {
+	case "":
+		c.OverflowPolicy = defaultPolicy
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowCoalesce:
+	default:
+		return fmt.Errorf("Invalid overflow policy %q for %s", c.OverflowPolicy, stage)
+	}
+	return nil
+}
+
+// Spool configures the writer of the check result files
+type Spool struct {
+	CheckResultsDir   string         `hcl:"check_results_dir"`
+	MaxResultsPerFile int            `hcl:"max_results_per_file"`
+	MaxFlushDelayTpl  string         `hcl:"max_flush_delay"`
+	MaxFlushDelay     time.Duration  `hcl:"-"`
+	MaxPendingFiles   int64          `hcl:"max_pending_files"`
+	MaxPendingSizeTpl string         `hcl:"max_pending_size"`
+	MaxPendingSize    int64          `hcl:"-"`
+	OverflowPolicy    OverflowPolicy `hcl:"overflow_policy"`
+	ScanIntervalTpl   string         `hcl:"scan_interval"`
+	ScanInterval      time.Duration  `hcl:"-"`
+	FileModeTpl       string         `hcl:"file_mode"`
+	FileMode          os.FileMode    `hcl:"-"`
+	FileOwner         string         `hcl:"file_owner"`
+	FileGroup         string         `hcl:"file_group"`
+	UID               int            `hcl:"-"` // -1 to keep the owner of the process
+	GID               int            `hcl:"-"` // -1 to keep the group of the process
+}
+
+func (c *Spool) Parse(name string) (err error) {
+	if c.CheckResultsDir == "" {
+		return fmt.Errorf("Missing check_results_dir for output %s", name)
+	}
+	if c.MaxResultsPerFile <= 0 {
+		c.MaxResultsPerFile = 100
+	}
+	if c.MaxFlushDelay, err = parseDuration(c.MaxFlushDelayTpl, "1s"); err != nil {
+		return
+	}
+
+	if c.MaxPendingSizeTpl != "" {
+		size, err := humanize.ParseBytes(c.MaxPendingSizeTpl)
+		if err != nil {
+			return err
+		}
+		c.MaxPendingSize = int64(size)
+	}
+
+	switch c.OverflowPolicy {
+	case "":
+		c.OverflowPolicy = OverflowDropNewest
+	case OverflowDropNewest, OverflowDropOldest, OverflowCoalesce:
+	default:
+		return fmt.Errorf("Invalid overflow_policy %q for output %s", c.OverflowPolicy, name)
+	}
+
+	if c.ScanInterval, err = parseDuration(c.ScanIntervalTpl, "10s"); err != nil {
+		return
+	}
+
+	if c.FileModeTpl == "" {
+		c.FileModeTpl = "0770"
+	}
+	mode, err := strconv.ParseUint(c.FileModeTpl, 8, 32)
+	if err != nil {
+		return fmt.Errorf("Invalid file_mode %q for output %s", c.FileModeTpl, name)
+	}
+	c.FileMode = os.FileMode(mode)
+
+	c.UID = -1
+	if c.FileOwner != "" {
+		if c.UID, err = lookupID(c.FileOwner, lookupUser); err != nil {
+			return
+		}
+	}
+	c.GID = -1
+	if c.FileGroup != "" {
+		if c.GID, err = lookupID(c.FileGroup, lookupGroup); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func lookupUser(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGroup(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// lookupID resolves a user or group name, or returns it as is when it is numeric
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+// HasQuota returns true when the number or the size of the pending files is limited
+func (c *Spool) HasQuota() bool {
+	return c.MaxPendingFiles > 0 || c.MaxPendingSize > 0
+}
+
+// NSCA configures the client sending the check results to a NSCA server
+type NSCA struct {
+	Address         string        `hcl:"address"`
+	Password        string        `hcl:"password"`
+	Encryption      string        `hcl:"encryption"`
+	Connections     int           `hcl:"connections"`
+	QueueSize       int           `hcl:"queue_size"`
+	BlockQueue      bool          `hcl:"-"`
+	Retries         int           `hcl:"retries"`
+	RetryDelayTpl   string        `hcl:"retry_delay"`
+	RetryDelay      time.Duration `hcl:"-"`
+	TimeoutTpl      string        `hcl:"timeout"`
+	Timeout         time.Duration `hcl:"-"`
+	IdleTimeoutTpl  string        `hcl:"idle_timeout"`
+	IdleTimeout     time.Duration `hcl:"-"`
+	MaxOutputLength int           `hcl:"max_output_length"`
+}
+
+func (c *NSCA) Parse() (err error) {
+	if c.Address == "" {
+		return fmt.Errorf("Missing nsca address")
+	}
+	if c.Encryption == "" {
+		c.Encryption = "none"
+	}
+	if c.Connections <= 0 {
+		c.Connections = 2
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 1000
+	}
+	if c.Retries < 0 {
+		c.Retries = 0
+	}
+	if c.MaxOutputLength <= 0 {
+		c.MaxOutputLength = 512
+	}
+
+	if c.RetryDelay, err = parseDuration(c.RetryDelayTpl, "1s"); err != nil {
+		return
+	}
+	if c.Timeout, err = parseDuration(c.TimeoutTpl, "10s"); err != nil {
+		return
+	}
+	c.IdleTimeout, err = parseDuration(c.IdleTimeoutTpl, "30s")
+	return
+}
+
+// TLS configures the TLS client of the HTTP outputs
+type TLS struct {
+	CAFile             string `hcl:"ca_file"`
+	CertFile           string `hcl:"cert_file"`
+	KeyFile            string `hcl:"key_file"`
+	InsecureSkipVerify bool   `hcl:"insecure_skip_verify"`
+}
+
+func (c *TLS) TLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", c.CAFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificate found in %s", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// NRDP configures the client submitting the check results to a NRDP server
+type NRDP struct {
+	URL              string        `hcl:"url"`
+	Token            string        `hcl:"token"`
+	Format           string        `hcl:"format"`
+	BatchSize        int           `hcl:"batch_size"`
+	FlushIntervalTpl string        `hcl:"flush_interval"`
+	FlushInterval    time.Duration `hcl:"-"`
+	QueueSize        int           `hcl:"queue_size"`
+	BlockQueue       bool          `hcl:"-"`
+	Retries          int           `hcl:"retries"`
+	RetryDelayTpl    string        `hcl:"retry_delay"`
+	RetryDelay       time.Duration `hcl:"-"`
+	MaxRetryDelayTpl string        `hcl:"max_retry_delay"`
+	MaxRetryDelay    time.Duration `hcl:"-"`
+	TimeoutTpl       string        `hcl:"timeout"`
+	Timeout          time.Duration `hcl:"-"`
+	TLS              TLS           `hcl:"-"`
+}
+
+func (c *NRDP) Parse() (err error) {
+	if c.URL == "" {
+		return fmt.Errorf("Missing nrdp url")
+	}
+	switch c.Format {
+	case "":
+		c.Format = "xml"
+	case "xml", "json":
+	default:
+		return fmt.Errorf("Invalid nrdp format %q", c.Format)
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 10000
+	}
+	if c.Retries < 0 {
+		c.Retries = 0
+	}
+
+	if c.FlushInterval, err = parseDuration(c.FlushIntervalTpl, "5s"); err != nil {
+		return
+	}
+	if c.RetryDelay, err = parseDuration(c.RetryDelayTpl, "1s"); err != nil {
+		return
+	}
+	if c.MaxRetryDelay, err = parseDuration(c.MaxRetryDelayTpl, "1m"); err != nil {
+		return
+	}
+	c.Timeout, err = parseDuration(c.TimeoutTpl, "10s")
+	return
+}
+
+// Icinga2 configures the client sending the check results to the Icinga 2 API
+type Icinga2 struct {
+	URL              string        `hcl:"url"`
+	Username         string        `hcl:"username"`
+	Password         string        `hcl:"password"`
+	CheckSource      string        `hcl:"check_source"`
+	Concurrency      int           `hcl:"concurrency"`
+	QueueSize        int           `hcl:"queue_size"`
+	BlockQueue       bool          `hcl:"-"`
+	Retries          int           `hcl:"retries"`
+	RetryDelayTpl    string        `hcl:"retry_delay"`
+	RetryDelay       time.Duration `hcl:"-"`
+	MaxRetryDelayTpl string        `hcl:"max_retry_delay"`
+	MaxRetryDelay    time.Duration `hcl:"-"`
+	TimeoutTpl       string        `hcl:"timeout"`
+	Timeout          time.Duration `hcl:"-"`
+	TLS              TLS           `hcl:"-"`
+}
+
+func (c *Icinga2) Parse() (err error) {
+	if c.URL == "" {
+		return fmt.Errorf("Missing icinga2 url")
+	}
+	if c.CheckSource == "" {
+		if c.CheckSource, err = os.Hostname(); err != nil {
+			return
+		}
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 4
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 10000
+	}
+	if c.Retries < 0 {
+		c.Retries = 0
+	}
+
+	if c.RetryDelay, err = parseDuration(c.RetryDelayTpl, "1s"); err != nil {
+		return
+	}
+	if c.MaxRetryDelay, err = parseDuration(c.MaxRetryDelayTpl, "1m"); err != nil {
+		return
+	}
+	c.Timeout, err = parseDuration(c.TimeoutTpl, "10s")
+	return
+}
+
+// Prometheus configures the HTTP endpoint exposing the last check results
+type Prometheus struct {
+	Listen        string        `hcl:"listen"`
+	MetricsPath   string        `hcl:"metrics_path"`
+	StaleAfterTpl string        `hcl:"stale_after"`
+	StaleAfter    time.Duration `hcl:"-"` // 0 keeps the series forever
+}
+
+func (c *Prometheus) Parse() (err error) {
+	if c.Listen == "" {
+		c.Listen = ":9567"
+	}
+	if c.MetricsPath == "" {
+		c.MetricsPath = "/metrics"
+	}
+	c.StaleAfter, err = parseDuration(c.StaleAfterTpl, "15m")
+	return
+}
+
+// Alertmanager configures the client sending the non-OK check results as alerts to Alertmanager
+type Alertmanager struct {
+	URL               string        `hcl:"url"`
+	Username          string        `hcl:"username"`
+	Password          string        `hcl:"password"`
+	QueueSize         int           `hcl:"queue_size"`
+	BlockQueue        bool          `hcl:"-"`
+	ResendIntervalTpl string        `hcl:"resend_interval"`
+	ResendInterval    time.Duration `hcl:"-"`
+	TimeoutTpl        string        `hcl:"timeout"`
+	Timeout           time.Duration `hcl:"-"`
+	TLS               TLS           `hcl:"-"`
+}
+
+func (c *Alertmanager) Parse() (err error) {
+	if c.URL == "" {
+		return fmt.Errorf("Missing alertmanager url")
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 10000
+	}
+
+	if c.ResendInterval, err = parseDuration(c.ResendIntervalTpl, "1m"); err != nil {
+		return
+	}
+	c.Timeout, err = parseDuration(c.TimeoutTpl, "10s")
+	return
+}
+
+type WebhookMode string
+
+const (
+	WebhookOnChange WebhookMode = "change"
+	WebhookAll      WebhookMode = "all"
+)
+
+// Webhook configures the HTTP requests sent for the check results
+type Webhook struct {
+	URL              string            `hcl:"url"`
+	Method           string            `hcl:"method"`
+	Headers          map[string]string `hcl:"headers"`
+	Mode             WebhookMode       `hcl:"mode"`
+	Secret           string            `hcl:"secret"`
+	SignatureHeader  string            `hcl:"signature_header"`
+	DeadLetterFile   string            `hcl:"dead_letter_file"`
+	QueueSize        int               `hcl:"queue_size"`
+	BlockQueue       bool              `hcl:"-"`
+	Retries          int               `hcl:"retries"`
+	RetryDelayTpl    string            `hcl:"retry_delay"`
+	RetryDelay       time.Duration     `hcl:"-"`
+	MaxRetryDelayTpl string            `hcl:"max_retry_delay"`
+	MaxRetryDelay    time.Duration     `hcl:"-"`
+	TimeoutTpl       string            `hcl:"timeout"`
+	Timeout          time.Duration     `hcl:"-"`
+	Template         string            `hcl:"-"`
+	TLS              TLS               `hcl:"-"`
+}
+
+func (c *Webhook) Parse() (err error) {
+	if c.URL == "" {
+		return fmt.Errorf("Missing webhook url")
+	}
+	if c.Method == "" {
+		c.Method = "POST"
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = WebhookOnChange
+	case WebhookOnChange, WebhookAll:
+	default:
+		return fmt.Errorf("Invalid webhook mode %q", c.Mode)
+	}
+	if c.SignatureHeader == "" {
+		c.SignatureHeader = "X-Nmp-Signature"
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 10000
+	}
+	if c.Retries < 0 {
+		c.Retries = 0
+	}
+
+	if c.RetryDelay, err = parseDuration(c.RetryDelayTpl, "1s"); err != nil {
+		return
+	}
+	if c.MaxRetryDelay, err = parseDuration(c.MaxRetryDelayTpl, "1m"); err != nil {
+		return
+	}
+	c.Timeout, err = parseDuration(c.TimeoutTpl, "10s")
+	return
+}
+
+// Zabbix configures the client sending the check results to Zabbix trapper items
+type Zabbix struct {
+	Address          string        `hcl:"address"`
+	HostTemplate     string        `hcl:"host_template"`
+	KeyTemplate      string        `hcl:"key_template"`
+	ValueTemplate    string        `hcl:"value_template"`
+	BatchSize        int           `hcl:"batch_size"`
+	FlushIntervalTpl string        `hcl:"flush_interval"`
+	FlushInterval    time.Duration `hcl:"-"`
+	QueueSize        int           `hcl:"queue_size"`
+	BlockQueue       bool          `hcl:"-"`
+	Retries          int           `hcl:"retries"`
+	RetryDelayTpl    string        `hcl:"retry_delay"`
+	RetryDelay       time.Duration `hcl:"-"`
+	TimeoutTpl       string        `hcl:"timeout"`
+	Timeout          time.Duration `hcl:"-"`
+}
+
+func (c *Zabbix) Parse() (err error) {
+	if c.Address == "" {
+		return fmt.Errorf("Missing zabbix address")
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		c.Address = net.JoinHostPort(c.Address, "10051")
+	}
+	if c.HostTemplate == "" {
+		c.HostTemplate = "{{ .Hostname }}"
+	}
+	if c.KeyTemplate == "" {
+		c.KeyTemplate = "nmp[{{ .ServiceName }}]"
+	}
+	if c.ValueTemplate == "" {
+		c.ValueTemplate = "{{ if .Value }}{{ .Value }}{{ else }}{{ .Code }}{{ end }}"
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 250
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 10000
+	}
+	if c.Retries < 0 {
+		c.Retries = 0
+	}
+
+	if c.FlushInterval, err = parseDuration(c.FlushIntervalTpl, "5s"); err != nil {
+		return
+	}
+	if c.RetryDelay, err = parseDuration(c.RetryDelayTpl, "1s"); err != nil {
+		return
+	}
+	c.Timeout, err = parseDuration(c.TimeoutTpl, "10s")
+	return
+}
+
+// Fluentd configures the client forwarding the check results to fluentd or fluent-bit
+type Fluentd struct {
+	Address          string        `hcl:"address"`
+	Tag              string        `hcl:"tag"`
+	BatchSize        int           `hcl:"batch_size"`
+	FlushIntervalTpl string        `hcl:"flush_interval"`
+	FlushInterval    time.Duration `hcl:"-"`
+	QueueSize        int           `hcl:"queue_size"`
+	BlockQueue       bool          `hcl:"-"`
+	Retries          int           `hcl:"retries"`
+	RetryDelayTpl    string        `hcl:"retry_delay"`
+	RetryDelay       time.Duration `hcl:"-"`
+	TimeoutTpl       string        `hcl:"timeout"`
+	Timeout          time.Duration `hcl:"-"`
+}
+
+func (c *Fluentd) Parse() (err error) {
+	if c.Address == "" {
+		return fmt.Errorf("Missing fluentd address")
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		c.Address = net.JoinHostPort(c.Address, "24224")
+	}
+	if c.Tag == "" {
+		c.Tag = "nmp.check_result"
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 10000
+	}
+	if c.Retries < 0 {
+		c.Retries = 0
+	}
+
+	if c.FlushInterval, err = parseDuration(c.FlushIntervalTpl, "1s"); err != nil {
+		return
+	}
+	if c.RetryDelay, err = parseDuration(c.RetryDelayTpl, "1s"); err != nil {
+		return
+	}
+	c.Timeout, err = parseDuration(c.TimeoutTpl, "10s")
+	return
+}
+
+// Graphite configures the client sending the evaluated values to carbon
+type Graphite struct {
+	Address           string        `hcl:"address"`
+	Prefix            string        `hcl:"prefix"`
+	QueueSize         int           `hcl:"queue_size"`
+	FlushIntervalTpl  string        `hcl:"flush_interval"`
+	FlushInterval     time.Duration `hcl:"-"`
+	ReconnectDelayTpl string        `hcl:"reconnect_delay"`
+	ReconnectDelay    time.Duration `hcl:"-"`
+	TimeoutTpl        string        `hcl:"timeout"`
+	Timeout           time.Duration `hcl:"-"`
+}
+
+func (c *Graphite) Parse() (err error) {
+	if c.Address == "" {
+		return fmt.Errorf("Missing graphite address")
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		c.Address = net.JoinHostPort(c.Address, "2003")
+	}
+	if c.Prefix == "" {
+		c.Prefix = "nmp"
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 10000
+	}
+
+	if c.FlushInterval, err = parseDuration(c.FlushIntervalTpl, "1s"); err != nil {
+		return
+	}
+	if c.ReconnectDelay, err = parseDuration(c.ReconnectDelayTpl, "10s"); err != nil {
+		return
+	}
+	c.Timeout, err = parseDuration(c.TimeoutTpl, "10s")
+	return
+}
+
+// Perfdata configures the perfdata files written for PNP4Nagios or Graphios
+type Perfdata struct {
+	PerfdataDir       string        `hcl:"perfdata_dir"`
+	FilePrefix        string        `hcl:"file_prefix"`
+	RotateIntervalTpl string        `hcl:"rotate_interval"`
+	RotateInterval    time.Duration `hcl:"-"`
+	RotateSizeTpl     string        `hcl:"rotate_size"`
+	RotateSize        int64         `hcl:"-"`
+}
+
+func (c *Perfdata) Parse() (err error) {
+	if c.PerfdataDir == "" {
+		return fmt.Errorf("Missing perfdata_dir")
+	}
+	if c.FilePrefix == "" {
+		c.FilePrefix = "service-perfdata"
+	}
+	if c.RotateSizeTpl != "" {
+		size, err := humanize.ParseBytes(c.RotateSizeTpl)
+		if err != nil {
+			return err
+		}
+		c.RotateSize = int64(size)
+	}
+	c.RotateInterval, err = parseDuration(c.RotateIntervalTpl, "15s")
+	return
+}
@@ -1,6 +1,8 @@
 package consul
 
 import (
+	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/consul/api"
@@ -10,8 +12,14 @@ import (
 var nodeCache *cache.Cache
 var client *api.Client
 
+// generation is incremented whenever a node is added, removed or has its metadata changed
+var generation uint64
+
 func init() {
 	nodeCache = cache.New(5*time.Minute, 10*time.Minute)
+	nodeCache.OnEvicted(func(string, interface{}) {
+		atomic.AddUint64(&generation, 1)
+	})
 }
 
 func loadNodesFromAllDatacenters() error {
@@ -40,16 +48,29 @@ func loadNodesFromAllDatacenters() error {
 				continue
 			}
 			if name, ok := n.Meta["name"]; ok {
-				nodeCache.Set(name, n, cache.DefaultExpiration)
+				SetNode(name, n)
 			}
 		}
 	}
 	return nil
 }
 
+// SetNode caches the node of a host, and changes the generation when its metadata changed
+func SetNode(host string, node *api.Node) {
+	if old, found := nodeCache.Get(host); !found || !reflect.DeepEqual(old.(*api.Node).Meta, node.Meta) {
+		defer atomic.AddUint64(&generation, 1)
+	}
+	nodeCache.Set(host, node, cache.DefaultExpiration)
+}
+
 func GetNode(host string) *api.Node {
 	if n, found := nodeCache.Get(host); found {
 		return n.(*api.Node)
 	}
 	return nil
 }
+
+// Generation returns a counter which changes whenever the result of GetNode may have changed
+func Generation() uint64 {
+	return atomic.LoadUint64(&generation)
+}
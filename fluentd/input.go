@@ -1,28 +1,34 @@
 package fluentd
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"reflect"
 	"sync"
 	"sync/atomic"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/ugorji/go/codec"
 
+	"github.com/MiLk/nmp/msgpack"
 	"github.com/MiLk/nmp/shared"
 )
 
+// maxMessageSize is the number of bytes a client can send in one message
+const maxMessageSize = msgpack.DefaultMaxSize
+
 type forwardClient struct {
-	input  *ForwardInput
-	logger *logrus.Logger
-	conn   *net.TCPConn
-	codec  *codec.MsgpackHandle
-	dec    *codec.Decoder
+	input        *ForwardInput
+	logger       *logrus.Logger
+	conn         *net.TCPConn
+	reader       *msgpack.Reader
+	packed       []byte
+	packedBytes  *bytes.Reader
+	packedReader *msgpack.Reader
+	stream       shared.RecordStream
+	tag          string
+	records      []shared.TinyRecord
 }
 
 type ForwardInput struct {
@@ -31,7 +37,6 @@ type ForwardInput struct {
 	logger         *logrus.Logger
 	bind           string
 	listener       *net.TCPListener
-	codec          *codec.MsgpackHandle
 	clientsMtx     sync.Mutex
 	clients        map[*net.TCPConn]*forwardClient
 	wg             sync.WaitGroup
@@ -46,133 +51,142 @@ type ConnectionCountTopic struct{}
 
 type ForwardInputFactory struct{}
 
-func coerceInPlace(data map[string]interface{}) {
-	for k, v := range data {
-		switch v_ := v.(type) {
-		case []byte:
-			data[k] = string(v_) // XXX: byte => rune
-		case map[string]interface{}:
-			coerceInPlace(v_)
-		}
+// internTag returns the tag as a string, without allocating it again
+// while the client keeps sending the same tag
+func (c *forwardClient) internTag(tag []byte) string {
+	if string(tag) != c.tag {
+		c.tag = string(tag)
 	}
+	return c.tag
 }
 
-func (c *forwardClient) decodeRecordSet(tag []byte, entries []interface{}) (shared.RecordSet, error) {
+func (c *forwardClient) decodeRecord(reader *msgpack.Reader, tag string, timestamp uint64) error {
+	if c.stream != nil {
+		return c.stream.Decode(reader, tag, timestamp)
+	}
 
-	records := make([]shared.TinyRecord, len(entries))
-	for i, _entry := range entries {
-		entry, ok := _entry.([]interface{})
-		if !ok {
-			return shared.RecordSet{}, errors.New("Failed to decode recordSet")
-		}
-		var timestamp = uint64(0)
-		timestampFloat, ok := entry[0].(float64)
-		if !ok {
-			timestamp, ok = entry[0].(uint64)
-			if !ok {
-				return shared.RecordSet{}, errors.New("Failed to decode timestamp field")
-			}
-		} else {
-			timestamp = uint64(timestampFloat)
-		}
+	v, err := reader.ReadValue()
+	if err != nil {
+		return err
+	}
+	data, ok := v.(map[string]interface{})
+	if !ok {
+		return errors.New("Failed to decode data field")
+	}
+	c.records = append(c.records, shared.TinyRecord{
+		Timestamp: timestamp,
+		Data:      data,
+	})
+	return nil
+}
 
-		data, ok := entry[1].(map[string]interface{})
-		if !ok {
-			return shared.RecordSet{}, errors.New("Failed to decode data field")
-		}
-		coerceInPlace(data)
-		records[i] = shared.TinyRecord{
-			Timestamp: timestamp,
-			Data:      data,
+// decodeEntry decodes a [time, record] entry of the forward and packed forward modes
+func (c *forwardClient) decodeEntry(reader *msgpack.Reader, tag string) error {
+	n, err := reader.ReadArrayLen()
+	if err != nil {
+		return err
+	}
+	if n < 2 {
+		return errors.New("Failed to decode recordSet")
+	}
+	timestamp, err := reader.ReadTime()
+	if err != nil {
+		return err
+	}
+	if err := c.decodeRecord(reader, tag, timestamp); err != nil {
+		return err
+	}
+	for i := 2; i < n; i++ {
+		if err := reader.Skip(); err != nil {
+			return err
 		}
 	}
-	return shared.RecordSet{
-		Tag:     string(tag), // XXX: byte => rune
-		Records: records,
-	}, nil
+	return nil
+}
+
+func (c *forwardClient) flush(tag string) error {
+	if c.stream != nil {
+		return c.stream.Flush()
+	}
+	if len(c.records) == 0 {
+		return nil
+	}
+	recordSet := shared.RecordSet{Tag: tag, Records: c.records}
+	c.records = nil
+	return c.input.port.Emit([]shared.RecordSet{recordSet})
 }
 
-func (c *forwardClient) decodeEntries() ([]shared.RecordSet, error) {
-	v := []interface{}{nil, nil, nil}
-	err := c.dec.Decode(&v)
+// decodeEntries decodes one message, in message mode [tag, time, record],
+// forward mode [tag, [[time, record], ...]] or packed forward mode [tag, entries],
+// optionally followed by an option map.
+func (c *forwardClient) decodeEntries() error {
+	c.reader.Limit(maxMessageSize)
+	n, err := c.reader.ReadArrayLen()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	tag, ok := v[0].([]byte)
-	if !ok {
-		return nil, errors.New("Failed to decode tag field")
+	if n < 2 {
+		return errors.New("Unexpected payload format")
+	}
+	_tag, err := c.reader.ReadBytes()
+	if err != nil {
+		return errors.New("Failed to decode tag field")
 	}
+	tag := c.internTag(_tag)
 
-	var retval []shared.RecordSet
-	switch timestamp_or_entries := v[1].(type) {
-	case uint64:
-		timestamp := timestamp_or_entries
-		data, ok := v[2].(map[string]interface{})
-		if !ok {
-			return nil, errors.New("Failed to decode data field")
-		}
-		coerceInPlace(data)
-		retval = []shared.RecordSet{
-			{
-				Tag: string(tag), // XXX: byte => rune
-				Records: []shared.TinyRecord{
-					{
-						Timestamp: timestamp,
-						Data:      data,
-					},
-				},
-			},
-		}
-	case float64:
-		timestamp := uint64(timestamp_or_entries)
-		data, ok := v[2].(map[string]interface{})
-		if !ok {
-			return nil, errors.New("Failed to decode data field")
-		}
-		retval = []shared.RecordSet{
-			{
-				Tag: string(tag), // XXX: byte => rune
-				Records: []shared.TinyRecord{
-					{
-						Timestamp: timestamp,
-						Data:      data,
-					},
-				},
-			},
+	next, err := c.reader.Next()
+	if err != nil {
+		return err
+	}
+	consumed := 2
+	switch next {
+	case msgpack.Array:
+		entries, err := c.reader.ReadArrayLen()
+		if err != nil {
+			return err
 		}
-	case []interface{}:
-		if !ok {
-			return nil, errors.New("Unexpected payload format")
+		for i := 0; i < entries; i++ {
+			if err := c.decodeEntry(c.reader, tag); err != nil {
+				return err
+			}
 		}
-		recordSet, err := c.decodeRecordSet(tag, timestamp_or_entries)
+	case msgpack.String, msgpack.Binary:
+		packed, err := c.reader.ReadBytes()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		retval = []shared.RecordSet{recordSet}
-	case []byte:
-		entries := make([]interface{}, 0)
-		reader := bytes.NewReader(timestamp_or_entries)
-		dec := codec.NewDecoder(reader, c.codec)
-		for reader.Len() > 0 { // codec.Decoder doesn't return EOF.
-			entry := []interface{}{}
-			if err != dec.Decode(&entry) {
-				if err == io.EOF { // in case codec.Decoder changes its behavior
-					break
-				}
-				return nil, err
+		c.packed = append(c.packed[:0], packed...)
+		c.packedBytes.Reset(c.packed)
+		c.packedReader.Reset(c.packedBytes)
+		c.packedReader.Limit(len(c.packed))
+		for c.packedReader.More() {
+			if err := c.decodeEntry(c.packedReader, tag); err != nil {
+				return err
 			}
-			entries = append(entries, entry)
 		}
-		recordSet, err := c.decodeRecordSet(tag, entries)
+	case msgpack.Uint, msgpack.Int, msgpack.Float, msgpack.Ext:
+		if n < 3 {
+			return errors.New("Failed to decode data field")
+		}
+		timestamp, err := c.reader.ReadTime()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		retval = []shared.RecordSet{recordSet}
+		if err := c.decodeRecord(c.reader, tag, timestamp); err != nil {
+			return err
+		}
+		consumed = 3
 	default:
-		return nil, errors.New(fmt.Sprintf("Unknown type: %t", timestamp_or_entries))
+		return errors.New(fmt.Sprintf("Unknown type: %d", next))
+	}
+
+	for i := consumed; i < n; i++ {
+		if err := c.reader.Skip(); err != nil {
+			return err
+		}
 	}
-	atomic.AddInt64(&c.input.entries, int64(len(retval)))
-	return retval, nil
+	atomic.AddInt64(&c.input.entries, 1)
+	return c.flush(tag)
 }
 
 func (c *forwardClient) startHandling() {
@@ -188,7 +202,7 @@ func (c *forwardClient) startHandling() {
 		}()
 		c.input.logger.Infof("Started handling connection from %s", c.conn.RemoteAddr().String())
 		for {
-			recordSets, err := c.decodeEntries()
+			err := c.decodeEntries()
 			if err != nil {
 				err_, ok := err.(net.Error)
 				if ok {
@@ -204,14 +218,6 @@ func (c *forwardClient) startHandling() {
 				}
 				break
 			}
-
-			if len(recordSets) > 0 {
-				err_ := c.input.port.Emit(recordSets)
-				if err_ != nil {
-					c.logger.Error(err_.Error())
-					break
-				}
-			}
 		}
 		c.input.logger.Infof("Ended handling connection from %s", c.conn.RemoteAddr().String())
 	}()
@@ -224,14 +230,25 @@ func (c *forwardClient) shutdown() {
 	}
 }
 
-func newForwardClient(input *ForwardInput, logger *logrus.Logger, conn *net.TCPConn, _codec *codec.MsgpackHandle) *forwardClient {
+// newForwardDecoder returns a client decoding the messages read from r
+func newForwardDecoder(input *ForwardInput, logger *logrus.Logger, r io.Reader) *forwardClient {
+	packedBytes := bytes.NewReader(nil)
 	c := &forwardClient{
-		input:  input,
-		logger: logger,
-		conn:   conn,
-		codec:  _codec,
-		dec:    codec.NewDecoder(bufio.NewReader(conn), _codec),
+		input:        input,
+		logger:       logger,
+		reader:       msgpack.NewReader(r),
+		packedBytes:  packedBytes,
+		packedReader: msgpack.NewReader(packedBytes),
+	}
+	if decoder, ok := input.port.(shared.RecordDecoder); ok {
+		c.stream = decoder.NewRecordStream()
 	}
+	return c
+}
+
+func newForwardClient(input *ForwardInput, logger *logrus.Logger, conn *net.TCPConn) *forwardClient {
+	c := newForwardDecoder(input, logger, conn)
+	c.conn = conn
 	input.markCharged(c)
 	return c
 }
@@ -278,7 +295,7 @@ func (input *ForwardInput) spawnDaemon() {
 			case conn := <-input.acceptChan:
 				if conn != nil {
 					input.logger.Info("Got conn from acceptChan")
-					newForwardClient(input, input.logger, conn, input.codec).startHandling()
+					newForwardClient(input, input.logger, conn).startHandling()
 				}
 			case <-input.shutdownChan:
 				input.listener.Close()
@@ -324,9 +341,6 @@ func (input *ForwardInput) Stop() {
 }
 
 func NewForwardInput(logger *logrus.Logger, bind string, port shared.InputListener) (*ForwardInput, error) {
-	_codec := codec.MsgpackHandle{}
-	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
-	_codec.RawToString = false
 	addr, err := net.ResolveTCPAddr("tcp", bind)
 	if err != nil {
 		logger.Error(err.Error())
@@ -342,7 +356,6 @@ func NewForwardInput(logger *logrus.Logger, bind string, port shared.InputListen
 		logger:         logger,
 		bind:           bind,
 		listener:       listener,
-		codec:          &_codec,
 		clients:        make(map[*net.TCPConn]*forwardClient),
 		clientsMtx:     sync.Mutex{},
 		entries:        0,
@@ -0,0 +1,223 @@
+package fluentd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ugorji/go/codec"
+
+	"github.com/MiLk/nmp/collectd"
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+// recorder receives the records of the transformer
+type recorder struct {
+	keep    bool
+	count   int
+	records []collectd.CollectdRecord
+}
+
+func (r *recorder) Emit(record collectd.CollectdRecord) error {
+	r.count++
+	if r.keep {
+		r.records = append(r.records, record)
+	}
+	return nil
+}
+
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+// newTestInput returns an input feeding a started collectd transformer
+func newTestInput(tb testing.TB, listener *recorder) (*ForwardInput, *collectd.Transformer) {
+	logger := newTestLogger()
+	transformer, err := collectd.NewTransformer(logger, []string{"collectd"}, config.ClockSkew{}, config.Buffer{Size: 10, OverflowPolicy: config.OverflowBlock}, listener)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	transformer.Start()
+	return &ForwardInput{port: transformer, logger: logger}, transformer
+}
+
+func encode(tb testing.TB, v interface{}) []byte {
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, &codec.MsgpackHandle{}).Encode(v); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func collectdFields(i int) map[string]interface{} {
+	return map[string]interface{}{
+		"host":            fmt.Sprintf("host%d", i%100),
+		"plugin":          "memory",
+		"plugin_instance": "",
+		"type":            "memory",
+		"type_instance":   "free",
+		"values":          []interface{}{1.5, uint64(i)},
+		"dstypes":         []interface{}{"gauge", "gauge"},
+		"dsnames":         []interface{}{"value", "count"},
+		"interval":        10.0,
+		"meta":            map[string]interface{}{"network:received": true},
+	}
+}
+
+// messageMode encodes one message per record: [tag, time, record]
+func messageMode(tb testing.TB, records int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < records; i++ {
+		buf.Write(encode(tb, []interface{}{"collectd", uint64(1500000000 + i), collectdFields(i)}))
+	}
+	return buf.Bytes()
+}
+
+// forwardMode encodes the records in one message: [tag, [[time, record], ...]]
+func forwardMode(tb testing.TB, records int) []byte {
+	entries := make([]interface{}, records)
+	for i := range entries {
+		entries[i] = []interface{}{uint64(1500000000 + i), collectdFields(i)}
+	}
+	return encode(tb, []interface{}{"collectd", entries})
+}
+
+// packedForwardMode encodes the records as fluentd does with its buffers:
+// [tag, [time, record][time, record]..., {"size": n}], the times being EventTime
+func packedForwardMode(tb testing.TB, records int) []byte {
+	var entries bytes.Buffer
+	for i := 0; i < records; i++ {
+		entries.Write([]byte{0x92, 0xd7, 0x00})
+		binary.Write(&entries, binary.BigEndian, uint32(1500000000+i))
+		binary.Write(&entries, binary.BigEndian, uint32(0))
+		entries.Write(encode(tb, collectdFields(i)))
+	}
+	return encode(tb, []interface{}{"collectd", entries.Bytes(), map[string]interface{}{"size": records}})
+}
+
+func decodeAll(tb testing.TB, input *ForwardInput, data []byte) {
+	c := newForwardDecoder(input, input.logger, bytes.NewReader(data))
+	for {
+		err := c.decodeEntries()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func TestForwardInputDecodesModes(t *testing.T) {
+	modes := []struct {
+		name     string
+		encode   func(testing.TB, int) []byte
+		messages int64
+	}{
+		{"message", messageMode, 3},
+		{"forward", forwardMode, 1},
+		{"packed forward", packedForwardMode, 1},
+	}
+	for _, mode := range modes {
+		name := mode.name
+		listener := &recorder{keep: true}
+		input, transformer := newTestInput(t, listener)
+		decodeAll(t, input, mode.encode(t, 3))
+		transformer.Stop()
+		transformer.WaitForShutdown()
+
+		if len(listener.records) != 3 {
+			t.Fatalf("%s: expected 3 records, got %d", name, len(listener.records))
+		}
+		for i, record := range listener.records {
+			if record.Tag != "collectd" || record.Timestamp != uint64(1500000000+i) || record.Host != fmt.Sprintf("host%d", i) ||
+				record.Plugin != "memory" || record.Type != "memory" || record.TypeInstance != "free" || record.Interval != 10 {
+				t.Errorf("%s: unexpected record %d: %+v", name, i, record)
+			}
+			if expected := []interface{}{1.5, uint64(i)}; !reflect.DeepEqual(record.Values, expected) {
+				t.Errorf("%s: expected the values %v, got %v", name, expected, record.Values)
+			}
+			if fmt.Sprint(record.DsNames) != "[value count]" {
+				t.Errorf("%s: unexpected names %v", name, record.DsNames)
+			}
+		}
+		if input.entries != mode.messages {
+			t.Errorf("%s: expected %d messages, got %d", name, mode.messages, input.entries)
+		}
+	}
+}
+
+// emitUgorji is how the forward input decoded a message before the record streams:
+// generic maps with the []byte values converted to strings, sent to the transformer
+func emitUgorji(transformer *collectd.Transformer, handle *codec.MsgpackHandle, data []byte) error {
+	v := []interface{}{nil, nil, nil}
+	if err := codec.NewDecoderBytes(data, handle).Decode(&v); err != nil {
+		return err
+	}
+	recordSet := shared.RecordSet{Tag: string(v[0].([]byte))}
+	for _, _entry := range v[1].([]interface{}) {
+		entry := _entry.([]interface{})
+		record := entry[1].(map[string]interface{})
+		for k, v := range record {
+			if b, ok := v.([]byte); ok {
+				record[k] = string(b)
+			}
+		}
+		recordSet.Records = append(recordSet.Records, shared.TinyRecord{Timestamp: entry[0].(uint64), Data: record})
+	}
+	return transformer.Emit([]shared.RecordSet{recordSet})
+}
+
+func BenchmarkForwardDecode(b *testing.B) {
+	const records = 100
+	data := forwardMode(b, records)
+
+	run := func(b *testing.B, decode func(input *ForwardInput, transformer *collectd.Transformer) func() error) {
+		listener := &recorder{}
+		input, transformer := newTestInput(b, listener)
+		next := decode(input, transformer)
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := next(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		transformer.Stop()
+		transformer.WaitForShutdown()
+		if listener.count != b.N*records {
+			b.Fatalf("expected %d records, got %d", b.N*records, listener.count)
+		}
+	}
+
+	b.Run("ugorji", func(b *testing.B) {
+		run(b, func(input *ForwardInput, transformer *collectd.Transformer) func() error {
+			handle := &codec.MsgpackHandle{}
+			handle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+			return func() error {
+				return emitUgorji(transformer, handle, data)
+			}
+		})
+	})
+
+	b.Run("forwardClient", func(b *testing.B) {
+		run(b, func(input *ForwardInput, transformer *collectd.Transformer) func() error {
+			message := bytes.NewReader(data)
+			c := newForwardDecoder(input, input.logger, message)
+			return func() error {
+				message.Reset(data)
+				c.reader.Reset(message)
+				return c.decodeEntries()
+			}
+		})
+	})
+}
@@ -0,0 +1,201 @@
+package fluentd
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/msgpack"
+	"github.com/MiLk/nmp/shared"
+)
+
+// ForwardOutput sends the check results to fluentd or fluent-bit with the forward protocol
+type ForwardOutput struct {
+	counters       *shared.Counters
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	queue          chan shared.CheckResult
+	done           chan struct{}
+	isShuttingDown uintptr
+	config         config.Fluentd
+	writer         *msgpack.Writer
+	conn           net.Conn
+}
+
+// writeEntry writes the [time, record] entry of a check result
+func writeEntry(writer *msgpack.Writer, checkResult shared.CheckResult) {
+	timestamp := checkResult.Timestamp
+	if timestamp == 0 {
+		timestamp = uint64(time.Now().Unix())
+	}
+
+	writer.WriteArrayHeader(2)
+	writer.WriteUint(timestamp)
+	if checkResult.Value != "" {
+		writer.WriteMapHeader(8)
+	} else {
+		writer.WriteMapHeader(5)
+	}
+	writer.WriteString("hostname")
+	writer.WriteString(checkResult.Hostname)
+	writer.WriteString("type")
+	writer.WriteString(checkResult.Type)
+	writer.WriteString("service")
+	writer.WriteString(checkResult.ServiceName)
+	writer.WriteString("code")
+	writer.WriteUint(uint64(checkResult.Code))
+	writer.WriteString("output")
+	writer.WriteString(checkResult.Output)
+	if checkResult.Value != "" {
+		writer.WriteString("value")
+		writer.WriteString(checkResult.Value)
+		writer.WriteString("warning")
+		writer.WriteString(checkResult.Warning)
+		writer.WriteString("critical")
+		writer.WriteString(checkResult.Critical)
+	}
+}
+
+func (output *ForwardOutput) write(batch []shared.CheckResult) error {
+	if output.conn == nil {
+		conn, err := net.DialTimeout("tcp", output.config.Address, output.config.Timeout)
+		if err != nil {
+			return shared.RetryableError{Err: err}
+		}
+		output.conn = conn
+	}
+
+	// Forward mode: [tag, [[time, record], ...]]
+	output.conn.SetWriteDeadline(time.Now().Add(output.config.Timeout))
+	output.writer.Reset(output.conn)
+	output.writer.WriteArrayHeader(2)
+	output.writer.WriteString(output.config.Tag)
+	output.writer.WriteArrayHeader(len(batch))
+	for _, checkResult := range batch {
+		writeEntry(output.writer, checkResult)
+	}
+	if err := output.writer.Flush(); err != nil {
+		output.close()
+		return shared.RetryableError{Err: err}
+	}
+	return nil
+}
+
+func (output *ForwardOutput) close() {
+	if output.conn != nil {
+		output.conn.Close()
+		output.conn = nil
+	}
+}
+
+func (output *ForwardOutput) flush(batch []shared.CheckResult) {
+	backoff := shared.Backoff{Retries: output.config.Retries, Delay: output.config.RetryDelay}
+	if err := backoff.Retry(output.logger, output.counters, output.done, func() error { return output.write(batch) }); err == nil {
+		output.counters.Add(shared.CounterSent, len(batch))
+		return
+	}
+
+	output.counters.Add(shared.CounterFailed, len(batch))
+	output.logger.Errorf("Failed to forward %d check results to %s", len(batch), output.config.Address)
+}
+
+func (output *ForwardOutput) spawnForwarder() {
+	output.logger.Info("Spawning fluentd forwarder")
+	output.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(output.config.FlushInterval)
+		defer func() {
+			ticker.Stop()
+			output.close()
+			output.wg.Done()
+		}()
+		output.logger.Info("Fluentd forwarder started")
+
+		batch := make([]shared.CheckResult, 0, output.config.BatchSize)
+	loop:
+		for {
+			select {
+			case checkResult, ok := <-output.queue:
+				if !ok {
+					break loop
+				}
+				batch = append(batch, checkResult)
+				if len(batch) < output.config.BatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			output.flush(batch)
+			batch = batch[:0]
+		}
+
+		if len(batch) > 0 {
+			output.flush(batch)
+		}
+		output.logger.Info("Fluentd forwarder ended")
+	}()
+}
+
+func (output *ForwardOutput) Emit(checkResults []shared.CheckResult) error {
+	defer func() {
+		recover()
+	}()
+	for _, checkResult := range checkResults {
+		if output.config.BlockQueue {
+			output.queue <- checkResult
+			continue
+		}
+		select {
+		case output.queue <- checkResult:
+		default:
+			output.counters.Add(shared.CounterDropped, 1)
+			output.logger.Warnf("Fluentd output queue is full, dropping %s - %s", checkResult.Hostname, checkResult.ServiceName)
+		}
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the counters of the output
+func (output *ForwardOutput) Stats() map[string]uint64 {
+	return output.counters.Snapshot()
+}
+
+func (output *ForwardOutput) String() string {
+	return "fluentd output"
+}
+
+func (output *ForwardOutput) Stop() {
+	if atomic.CompareAndSwapUintptr(&output.isShuttingDown, 0, 1) {
+		close(output.queue)
+		close(output.done)
+	}
+}
+
+func (output *ForwardOutput) WaitForShutdown() {
+	output.wg.Wait()
+}
+
+func (output *ForwardOutput) Start() {
+	output.spawnForwarder()
+}
+
+func NewForwardOutput(logger *logrus.Logger, _config config.Fluentd) (*ForwardOutput, error) {
+	output := &ForwardOutput{
+		counters:       shared.NewCounters(shared.CounterSent, shared.CounterFailed, shared.CounterDropped, shared.CounterRetries),
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		queue:          make(chan shared.CheckResult, _config.QueueSize),
+		done:           make(chan struct{}),
+		isShuttingDown: 0,
+		config:         _config,
+		writer:         msgpack.NewWriter(nil),
+	}
+	return output, nil
+}
@@ -0,0 +1,192 @@
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+var invalidChars = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// Sender sends the evaluated value and the code of the check results to carbon.
+// The metrics are buffered while carbon is not reachable.
+type Sender struct {
+	counters       *shared.Counters // The counters are metrics, not check results
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	queue          chan shared.CheckResult
+	isShuttingDown uintptr
+	config         config.Graphite
+	conn           net.Conn
+	lastDial       time.Time
+	pending        []string
+}
+
+// sanitize turns a hostname or a service name into a single node of the metric path
+func sanitize(name string) string {
+	return invalidChars.ReplaceAllString(name, "_")
+}
+
+func (sender *Sender) lines(checkResult shared.CheckResult) []string {
+	timestamp := checkResult.Timestamp
+	if timestamp == 0 {
+		timestamp = uint64(time.Now().Unix())
+	}
+	path := fmt.Sprintf("%s.%s.%s", sender.config.Prefix, sanitize(checkResult.Hostname), sanitize(checkResult.ServiceName))
+	if checkResult.Type != "service" {
+		path = fmt.Sprintf("%s.%s.host", sender.config.Prefix, sanitize(checkResult.Hostname))
+	}
+
+	lines := []string{fmt.Sprintf("%s.state %d %d\n", path, checkResult.Code, timestamp)}
+	if _, err := strconv.ParseFloat(checkResult.Value, 64); err == nil {
+		lines = append(lines, fmt.Sprintf("%s.value %s %d\n", path, checkResult.Value, timestamp))
+	}
+	return lines
+}
+
+func (sender *Sender) buffer(lines []string) {
+	sender.pending = append(sender.pending, lines...)
+	if overflow := len(sender.pending) - sender.config.QueueSize; overflow > 0 {
+		sender.pending = sender.pending[overflow:]
+		sender.counters.Add(shared.CounterDropped, overflow)
+		sender.logger.Warnf("Graphite buffer is full, dropping %d metrics", overflow)
+	}
+}
+
+func (sender *Sender) connect(force bool) error {
+	if sender.conn != nil {
+		return nil
+	}
+	if !force && time.Since(sender.lastDial) < sender.config.ReconnectDelay {
+		return fmt.Errorf("Waiting before reconnecting to %s", sender.config.Address)
+	}
+	sender.lastDial = time.Now()
+
+	conn, err := net.DialTimeout("tcp", sender.config.Address, sender.config.Timeout)
+	if err != nil {
+		return err
+	}
+	sender.conn = conn
+	return nil
+}
+
+func (sender *Sender) close() {
+	if sender.conn != nil {
+		sender.conn.Close()
+		sender.conn = nil
+	}
+}
+
+// flush writes the buffered metrics, they are kept to be sent again if the connection fails
+func (sender *Sender) flush(force bool) {
+	if len(sender.pending) == 0 {
+		return
+	}
+	if err := sender.connect(force); err != nil {
+		sender.logger.Debug(err)
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, line := range sender.pending {
+		buf.WriteString(line)
+	}
+	sender.conn.SetWriteDeadline(time.Now().Add(sender.config.Timeout))
+	if _, err := sender.conn.Write(buf.Bytes()); err != nil {
+		sender.logger.Error(err)
+		sender.close()
+		return
+	}
+	sender.counters.Add(shared.CounterSent, len(sender.pending))
+	sender.pending = sender.pending[:0]
+}
+
+func (sender *Sender) spawnSender() {
+	sender.logger.Info("Spawning graphite sender")
+	sender.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(sender.config.FlushInterval)
+		defer func() {
+			ticker.Stop()
+			sender.close()
+			sender.wg.Done()
+		}()
+		sender.logger.Info("Graphite sender started")
+
+	loop:
+		for {
+			select {
+			case checkResult, ok := <-sender.queue:
+				if !ok {
+					break loop
+				}
+				sender.buffer(sender.lines(checkResult))
+			case <-ticker.C:
+				sender.flush(false)
+			}
+		}
+
+		sender.flush(true)
+		if len(sender.pending) > 0 {
+			sender.counters.Add(shared.CounterDropped, len(sender.pending))
+			sender.logger.Warnf("Dropping %d metrics not sent to %s", len(sender.pending), sender.config.Address)
+		}
+		sender.logger.Info("Graphite sender ended")
+	}()
+}
+
+func (sender *Sender) Emit(checkResults []shared.CheckResult) error {
+	defer func() {
+		recover()
+	}()
+	for _, checkResult := range checkResults {
+		sender.queue <- checkResult
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the counters of the sender
+func (sender *Sender) Stats() map[string]uint64 {
+	return sender.counters.Snapshot()
+}
+
+func (sender *Sender) String() string {
+	return "graphite"
+}
+
+func (sender *Sender) Stop() {
+	if atomic.CompareAndSwapUintptr(&sender.isShuttingDown, 0, 1) {
+		close(sender.queue)
+	}
+}
+
+func (sender *Sender) WaitForShutdown() {
+	sender.wg.Wait()
+}
+
+func (sender *Sender) Start() {
+	sender.spawnSender()
+}
+
+func NewSender(logger *logrus.Logger, _config config.Graphite) (*Sender, error) {
+	sender := &Sender{
+		counters:       shared.NewCounters(shared.CounterSent, shared.CounterDropped),
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		queue:          make(chan shared.CheckResult, 100),
+		isShuttingDown: 0,
+		config:         _config,
+		pending:        make([]string, 0, _config.QueueSize),
+	}
+	return sender, nil
+}
@@ -0,0 +1,212 @@
+package icinga2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+const processCheckResultPath = "/v1/actions/process-check-result"
+
+type processCheckResult struct {
+	Type            string   `json:"type"`
+	ExitStatus      uint8    `json:"exit_status"`
+	PluginOutput    string   `json:"plugin_output"`
+	PerformanceData []string `json:"performance_data,omitempty"`
+	CheckSource     string   `json:"check_source"`
+	ExecutionStart  float64  `json:"execution_start"`
+	ExecutionEnd    float64  `json:"execution_end"`
+}
+
+// Sender sends the check results to the process-check-result action of the Icinga 2 API
+type Sender struct {
+	counters       *shared.Counters
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	queue          chan shared.CheckResult
+	done           chan struct{}
+	isShuttingDown uintptr
+	config         config.Icinga2
+	client         *http.Client
+}
+
+func (sender *Sender) newRequest(checkResult shared.CheckResult) (*http.Request, error) {
+	now := time.Now()
+	start := now
+	if checkResult.Timestamp > 0 {
+		start = time.Unix(int64(checkResult.Timestamp), 0)
+	}
+
+	action := processCheckResult{
+		ExitStatus:     checkResult.Code,
+		PluginOutput:   checkResult.Output,
+		CheckSource:    sender.config.CheckSource,
+		ExecutionStart: float64(start.Unix()),
+		ExecutionEnd:   float64(now.UnixNano()) / float64(time.Second),
+	}
+
+	query := url.Values{}
+	if checkResult.Type == "service" {
+		action.Type = "Service"
+		query.Set("service", fmt.Sprintf("%s!%s", checkResult.Hostname, checkResult.ServiceName))
+	} else {
+		action.Type = "Host"
+		query.Set("host", checkResult.Hostname)
+	}
+	if perfData := checkResult.PerfData(); perfData != "" {
+		action.PerformanceData = []string{perfData}
+	}
+
+	body, err := json.Marshal(action)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimRight(sender.config.URL, "/") + processCheckResultPath + "?" + query.Encode()
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if sender.config.Username != "" {
+		req.SetBasicAuth(sender.config.Username, sender.config.Password)
+	}
+	return req, nil
+}
+
+func (sender *Sender) process(checkResult shared.CheckResult) error {
+	req, err := sender.newRequest(checkResult)
+	if err != nil {
+		return err
+	}
+
+	resp, err := sender.client.Do(req)
+	if err != nil {
+		return shared.RetryableError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return shared.RetryableError{Err: err}
+	}
+
+	if resp.StatusCode >= 500 {
+		return shared.RetryableError{Err: fmt.Errorf("Icinga 2 API returned %s: %s", resp.Status, body)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Icinga 2 API returned %s: %s", resp.Status, body)
+	}
+	return nil
+}
+
+func (sender *Sender) send(checkResult shared.CheckResult) {
+	backoff := shared.Backoff{Retries: sender.config.Retries, Delay: sender.config.RetryDelay, MaxDelay: sender.config.MaxRetryDelay}
+	if err := backoff.Retry(sender.logger, sender.counters, sender.done, func() error { return sender.process(checkResult) }); err == nil {
+		sender.counters.Add(shared.CounterSent, 1)
+		return
+	}
+
+	sender.counters.Add(shared.CounterFailed, 1)
+	sender.logger.Errorf("Failed to send %s - %s to %s", checkResult.Hostname, checkResult.ServiceName, sender.config.URL)
+}
+
+func (sender *Sender) spawnSender(id int) {
+	sender.logger.Infof("Spawning icinga2 sender %d", id)
+	sender.wg.Add(1)
+	go func() {
+		defer func() {
+			sender.wg.Done()
+		}()
+		sender.logger.Infof("Icinga2 sender %d started", id)
+
+		for checkResult := range sender.queue {
+			sender.send(checkResult)
+		}
+		sender.logger.Infof("Icinga2 sender %d ended", id)
+	}()
+}
+
+func (sender *Sender) Emit(checkResults []shared.CheckResult) error {
+	defer func() {
+		recover()
+	}()
+	for _, checkResult := range checkResults {
+		if sender.config.BlockQueue {
+			sender.queue <- checkResult
+			continue
+		}
+		select {
+		case sender.queue <- checkResult:
+		default:
+			sender.counters.Add(shared.CounterDropped, 1)
+			sender.logger.Warnf("Icinga2 queue is full, dropping %s - %s", checkResult.Hostname, checkResult.ServiceName)
+		}
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the counters of the sender
+func (sender *Sender) Stats() map[string]uint64 {
+	return sender.counters.Snapshot()
+}
+
+func (sender *Sender) String() string {
+	return "icinga2"
+}
+
+func (sender *Sender) Stop() {
+	if atomic.CompareAndSwapUintptr(&sender.isShuttingDown, 0, 1) {
+		close(sender.queue)
+		close(sender.done)
+	}
+}
+
+func (sender *Sender) WaitForShutdown() {
+	sender.wg.Wait()
+}
+
+func (sender *Sender) Start() {
+	for i := 0; i < sender.config.Concurrency; i++ {
+		sender.spawnSender(i)
+	}
+}
+
+func NewSender(logger *logrus.Logger, _config config.Icinga2) (*Sender, error) {
+	tlsConfig, err := _config.TLS.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	sender := &Sender{
+		counters:       shared.NewCounters(shared.CounterSent, shared.CounterFailed, shared.CounterDropped, shared.CounterRetries),
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		queue:          make(chan shared.CheckResult, _config.QueueSize),
+		done:           make(chan struct{}),
+		isShuttingDown: 0,
+		config:         _config,
+		client: &http.Client{
+			Timeout: _config.Timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSClientConfig:     tlsConfig,
+				MaxIdleConnsPerHost: _config.Concurrency,
+			},
+		},
+	}
+	return sender, nil
+}
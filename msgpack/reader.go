@@ -0,0 +1,627 @@
+package msgpack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Type is the kind of the next value of the stream
+type Type uint8
+
+const (
+	Nil Type = iota
+	Bool
+	Int
+	Uint
+	Float
+	String
+	Binary
+	Array
+	Map
+	Ext
+)
+
+// Type of the fluentd EventTime extension
+const eventTimeExt = 0
+
+// DefaultMaxSize is the number of bytes a new Reader accepts before Limit is called
+const DefaultMaxSize = 32 * 1024 * 1024
+
+// Number of elements allocated before reading an array or a map,
+// the larger ones grow as their elements are read
+const maxPreallocated = 16
+
+// Number of nested arrays and maps read by ReadValue and Skip,
+// so that a deeply nested value cannot exhaust the stack
+const maxDepth = 100
+
+var ErrTruncated = errors.New("msgpack: truncated value")
+
+var ErrTooLarge = errors.New("msgpack: value larger than the bytes left")
+
+var ErrTooDeep = errors.New("msgpack: value nested too deeply")
+
+// Reader decodes a msgpack stream value by value. Unlike a generic decoder,
+// it lets the caller read the values into its own structures without
+// building maps and interfaces for them.
+// The lengths sent by the peer are checked against the bytes left,
+// so a forged header cannot make it allocate more than the limit.
+type Reader struct {
+	r    *bufio.Reader
+	buf  []byte
+	left int // Number of bytes which can still be read
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r), left: DefaultMaxSize}
+}
+
+// Reset discards the buffered data and reads from r
+func (reader *Reader) Reset(r io.Reader) {
+	reader.r.Reset(r)
+}
+
+// Limit allows the next n bytes to be read, such as the maximum size of a message.
+// It must be called before every message of a stream.
+func (reader *Reader) Limit(n int) {
+	reader.left = n
+}
+
+// take consumes n bytes of the limit
+func (reader *Reader) take(n int) error {
+	if n < 0 || n > reader.left {
+		return ErrTooLarge
+	}
+	reader.left -= n
+	return nil
+}
+
+// fits checks that n values of at least size bytes can be left to read
+func (reader *Reader) fits(n int, size int) error {
+	if n < 0 || n > reader.left/size {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// More returns true while there is a value left to read
+func (reader *Reader) More() bool {
+	_, err := reader.r.Peek(1)
+	return err == nil
+}
+
+// read returns the next n bytes. They are only valid until the next read.
+func (reader *Reader) read(n int) ([]byte, error) {
+	if err := reader.take(n); err != nil {
+		return nil, err
+	}
+	if n <= reader.r.Size() {
+		b, err := reader.r.Peek(n)
+		if err != nil {
+			if err == io.EOF && len(b) > 0 {
+				err = ErrTruncated
+			}
+			return nil, err
+		}
+		reader.r.Discard(n)
+		return b, nil
+	}
+
+	if cap(reader.buf) < n {
+		reader.buf = make([]byte, n)
+	}
+	reader.buf = reader.buf[:n]
+	if _, err := io.ReadFull(reader.r, reader.buf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrTruncated
+		}
+		return nil, err
+	}
+	return reader.buf, nil
+}
+
+func (reader *Reader) readUint(size int) (uint64, error) {
+	b, err := reader.read(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// Next returns the type of the next value without consuming it
+func (reader *Reader) Next() (Type, error) {
+	b, err := reader.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return Uint, nil
+	case c <= 0x8f:
+		return Map, nil
+	case c <= 0x9f:
+		return Array, nil
+	case c <= 0xbf:
+		return String, nil
+	case c >= 0xe0:
+		return Int, nil
+	}
+
+	switch c {
+	case 0xc0:
+		return Nil, nil
+	case 0xc2, 0xc3:
+		return Bool, nil
+	case 0xc4, 0xc5, 0xc6:
+		return Binary, nil
+	case 0xc7, 0xc8, 0xc9, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return Ext, nil
+	case 0xca, 0xcb:
+		return Float, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return Uint, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		return Int, nil
+	case 0xd9, 0xda, 0xdb:
+		return String, nil
+	case 0xdc, 0xdd:
+		return Array, nil
+	case 0xde, 0xdf:
+		return Map, nil
+	}
+	return 0, fmt.Errorf("msgpack: invalid code 0x%x", c)
+}
+
+func (reader *Reader) readCode() (byte, error) {
+	if err := reader.take(1); err != nil {
+		return 0, err
+	}
+	return reader.r.ReadByte()
+}
+
+// checkLen returns the length read from a header, every element takes at least size bytes
+func (reader *Reader) checkLen(n uint64, size int, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(reader.left) {
+		return 0, ErrTooLarge
+	}
+	return int(n), reader.fits(int(n), size)
+}
+
+// ReadArrayLen reads the header of an array and returns its number of elements
+func (reader *Reader) ReadArrayLen() (int, error) {
+	c, err := reader.readCode()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case c >= 0x90 && c <= 0x9f:
+		return int(c & 0x0f), nil
+	case c == 0xdc:
+		n, err := reader.readUint(2)
+		return reader.checkLen(n, 1, err)
+	case c == 0xdd:
+		n, err := reader.readUint(4)
+		return reader.checkLen(n, 1, err)
+	}
+	return 0, fmt.Errorf("msgpack: expected an array, got code 0x%x", c)
+}
+
+// ReadMapLen reads the header of a map and returns its number of key/value pairs
+func (reader *Reader) ReadMapLen() (int, error) {
+	c, err := reader.readCode()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case c >= 0x80 && c <= 0x8f:
+		return int(c & 0x0f), nil
+	case c == 0xde:
+		n, err := reader.readUint(2)
+		return reader.checkLen(n, 2, err)
+	case c == 0xdf:
+		n, err := reader.readUint(4)
+		return reader.checkLen(n, 2, err)
+	}
+	return 0, fmt.Errorf("msgpack: expected a map, got code 0x%x", c)
+}
+
+func (reader *Reader) bytesLen(c byte) (int, bool, error) {
+	var n uint64
+	var err error
+	switch {
+	case c >= 0xa0 && c <= 0xbf:
+		n = uint64(c & 0x1f)
+	case c == 0xc4 || c == 0xd9:
+		n, err = reader.readUint(1)
+	case c == 0xc5 || c == 0xda:
+		n, err = reader.readUint(2)
+	case c == 0xc6 || c == 0xdb:
+		n, err = reader.readUint(4)
+	default:
+		return 0, false, nil
+	}
+	l, err := reader.checkLen(n, 1, err)
+	return l, true, err
+}
+
+// ReadBytes reads a string or a binary value. The returned slice is only
+// valid until the next read.
+func (reader *Reader) ReadBytes() ([]byte, error) {
+	c, err := reader.readCode()
+	if err != nil {
+		return nil, err
+	}
+	n, ok, err := reader.bytesLen(c)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("msgpack: expected a string, got code 0x%x", c)
+	}
+	return reader.read(n)
+}
+
+// ReadString reads a string or a binary value
+func (reader *Reader) ReadString() (string, error) {
+	b, err := reader.ReadBytes()
+	return string(b), err
+}
+
+// number is a decoded number, kept unboxed until the caller needs an interface
+type number struct {
+	t Type
+	u uint64
+	i int64
+	f float64
+}
+
+func (n number) value() interface{} {
+	switch n.t {
+	case Uint:
+		return n.u
+	case Int:
+		return n.i
+	}
+	return n.f
+}
+
+func (n number) float() float64 {
+	switch n.t {
+	case Uint:
+		return float64(n.u)
+	case Int:
+		return float64(n.i)
+	}
+	return n.f
+}
+
+// readNumber decodes a number of which the code has been read already
+func (reader *Reader) readNumber(c byte) (number, bool, error) {
+	switch {
+	case c <= 0x7f:
+		return number{t: Uint, u: uint64(c)}, true, nil
+	case c >= 0xe0:
+		return number{t: Int, i: int64(int8(c))}, true, nil
+	}
+
+	switch c {
+	case 0xca:
+		n, err := reader.readUint(4)
+		return number{t: Float, f: float64(math.Float32frombits(uint32(n)))}, true, err
+	case 0xcb:
+		n, err := reader.readUint(8)
+		return number{t: Float, f: math.Float64frombits(n)}, true, err
+	case 0xcc:
+		n, err := reader.readUint(1)
+		return number{t: Uint, u: n}, true, err
+	case 0xcd:
+		n, err := reader.readUint(2)
+		return number{t: Uint, u: n}, true, err
+	case 0xce:
+		n, err := reader.readUint(4)
+		return number{t: Uint, u: n}, true, err
+	case 0xcf:
+		n, err := reader.readUint(8)
+		return number{t: Uint, u: n}, true, err
+	case 0xd0:
+		n, err := reader.readUint(1)
+		return number{t: Int, i: int64(int8(n))}, true, err
+	case 0xd1:
+		n, err := reader.readUint(2)
+		return number{t: Int, i: int64(int16(n))}, true, err
+	case 0xd2:
+		n, err := reader.readUint(4)
+		return number{t: Int, i: int64(int32(n))}, true, err
+	case 0xd3:
+		n, err := reader.readUint(8)
+		return number{t: Int, i: int64(n)}, true, err
+	}
+	return number{}, false, nil
+}
+
+// ReadFloat64 reads any number as a float64
+func (reader *Reader) ReadFloat64() (float64, error) {
+	c, err := reader.readCode()
+	if err != nil {
+		return 0, err
+	}
+	n, ok, err := reader.readNumber(c)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("msgpack: expected a number, got code 0x%x", c)
+	}
+	return n.float(), nil
+}
+
+func (reader *Reader) extHeader(c byte) (int, int8, bool, error) {
+	var n uint64
+	var err error
+	switch c {
+	case 0xd4:
+		n = 1
+	case 0xd5:
+		n = 2
+	case 0xd6:
+		n = 4
+	case 0xd7:
+		n = 8
+	case 0xd8:
+		n = 16
+	case 0xc7:
+		n, err = reader.readUint(1)
+	case 0xc8:
+		n, err = reader.readUint(2)
+	case 0xc9:
+		n, err = reader.readUint(4)
+	default:
+		return 0, 0, false, nil
+	}
+	l, err := reader.checkLen(n, 1, err)
+	if err != nil {
+		return 0, 0, true, err
+	}
+	t, err := reader.readCode()
+	return l, int8(t), true, err
+}
+
+// ReadTime reads a fluentd timestamp, either a number of seconds
+// or an EventTime extension, and returns it in seconds.
+func (reader *Reader) ReadTime() (uint64, error) {
+	c, err := reader.readCode()
+	if err != nil {
+		return 0, err
+	}
+
+	n, t, ok, err := reader.extHeader(c)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		b, err := reader.read(n)
+		if err != nil {
+			return 0, err
+		}
+		if t != eventTimeExt || n != 8 {
+			return 0, fmt.Errorf("msgpack: unexpected extension %d of %d bytes for a timestamp", t, n)
+		}
+		return uint64(binary.BigEndian.Uint32(b[:4])), nil
+	}
+
+	number, ok, err := reader.readNumber(c)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case !ok:
+	case number.t == Uint:
+		return number.u, nil
+	case number.t == Int && number.i >= 0:
+		return uint64(number.i), nil
+	case number.t == Float && number.f >= 0:
+		return uint64(number.f), nil
+	}
+	return 0, fmt.Errorf("msgpack: invalid timestamp with code 0x%x", c)
+}
+
+func preallocated(n int) int {
+	if n > maxPreallocated {
+		return maxPreallocated
+	}
+	return n
+}
+
+// readKey reads the key of a map as a string
+func (reader *Reader) readKey(depth int) (string, error) {
+	if t, err := reader.Next(); err != nil || t == String || t == Binary {
+		if err != nil {
+			return "", err
+		}
+		return reader.ReadString()
+	}
+	key, err := reader.readValue(depth)
+	return fmt.Sprint(key), err
+}
+
+// ReadValue reads any value. Maps are returned as map[string]interface{},
+// arrays as []interface{}, strings and binary values as string,
+// integers as uint64 or int64 and floats as float64.
+func (reader *Reader) ReadValue() (interface{}, error) {
+	return reader.readValue(0)
+}
+
+func (reader *Reader) readValue(depth int) (interface{}, error) {
+	t, err := reader.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t {
+	case Nil:
+		_, err := reader.readCode()
+		return nil, err
+	case Bool:
+		c, err := reader.readCode()
+		return c == 0xc3, err
+	case Int, Uint, Float:
+		c, err := reader.readCode()
+		if err != nil {
+			return nil, err
+		}
+		n, _, err := reader.readNumber(c)
+		return n.value(), err
+	case String, Binary:
+		return reader.ReadString()
+	case Array:
+		if depth >= maxDepth {
+			return nil, ErrTooDeep
+		}
+		n, err := reader.ReadArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, 0, preallocated(n))
+		for i := 0; i < n; i++ {
+			v, err := reader.readValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	case Map:
+		if depth >= maxDepth {
+			return nil, ErrTooDeep
+		}
+		n, err := reader.ReadMapLen()
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]interface{}, preallocated(n))
+		for i := 0; i < n; i++ {
+			key, err := reader.readKey(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			value, err := reader.readValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			values[key] = value
+		}
+		return values, nil
+	}
+
+	c, err := reader.readCode()
+	if err != nil {
+		return nil, err
+	}
+	n, _, _, err := reader.extHeader(c)
+	if err != nil {
+		return nil, err
+	}
+	b, err := reader.read(n)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), b...), nil
+}
+
+// Skip reads the next value and discards it
+func (reader *Reader) Skip() error {
+	return reader.skip(0)
+}
+
+func (reader *Reader) skip(depth int) error {
+	t, err := reader.Next()
+	if err != nil {
+		return err
+	}
+
+	switch t {
+	case Array:
+		if depth >= maxDepth {
+			return ErrTooDeep
+		}
+		n, err := reader.ReadArrayLen()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := reader.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case Map:
+		if depth >= maxDepth {
+			return ErrTooDeep
+		}
+		n, err := reader.ReadMapLen()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 2*n; i++ {
+			if err := reader.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	c, err := reader.readCode()
+	if err != nil {
+		return err
+	}
+	size := 0
+	switch t {
+	case Nil, Bool:
+	case Int, Uint, Float:
+		switch c {
+		case 0xcc, 0xd0:
+			size = 1
+		case 0xcd, 0xd1:
+			size = 2
+		case 0xca, 0xce, 0xd2:
+			size = 4
+		case 0xcb, 0xcf, 0xd3:
+			size = 8
+		}
+	case String, Binary:
+		if size, _, err = reader.bytesLen(c); err != nil {
+			return err
+		}
+	case Ext:
+		if size, _, _, err = reader.extHeader(c); err != nil {
+			return err
+		}
+	}
+	if size == 0 {
+		return nil
+	}
+	if err := reader.take(size); err != nil {
+		return err
+	}
+	_, err = reader.r.Discard(size)
+	if err == io.EOF {
+		err = ErrTruncated
+	}
+	return err
+}
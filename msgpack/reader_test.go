@@ -0,0 +1,82 @@
+package msgpack
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestReaderRejectsForgedLengths(t *testing.T) {
+	headers := map[string][]byte{
+		"array32": {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"map32":   {0xdf, 0xff, 0xff, 0xff, 0xff},
+		"str32":   {0xdb, 0xff, 0xff, 0xff, 0xff},
+		"bin32":   {0xc6, 0xff, 0xff, 0xff, 0xff},
+		"ext32":   {0xc9, 0xff, 0xff, 0xff, 0xff, 0x00},
+		"nested":  {0x91, 0xdd, 0x00, 0x01, 0x00, 0x00},
+	}
+	for name, header := range headers {
+		reader := NewReader(bytes.NewReader(header))
+		reader.Limit(1024)
+		if _, err := reader.ReadValue(); err != ErrTooLarge {
+			t.Errorf("%s: expected ErrTooLarge from ReadValue, got %v", name, err)
+		}
+
+		reader = NewReader(bytes.NewReader(header))
+		reader.Limit(1024)
+		if err := reader.Skip(); err != ErrTooLarge {
+			t.Errorf("%s: expected ErrTooLarge from Skip, got %v", name, err)
+		}
+	}
+}
+
+func TestReaderRejectsDeepNesting(t *testing.T) {
+	// [[[...nil...]]] and {"k": {"k": ...nil...}}
+	nested := func(depth int, header ...byte) []byte {
+		return append(bytes.Repeat(header, depth), 0xc0)
+	}
+	values := map[string][]byte{
+		"arrays": nested(1024*1024, 0x91),
+		"maps":   nested(maxDepth+1, 0x81, 0xa1, 'k'),
+		"keys":   nested(maxDepth+1, 0x81, 0x91),
+	}
+	for name, value := range values {
+		if _, err := NewReader(bytes.NewReader(value)).ReadValue(); err != ErrTooDeep {
+			t.Errorf("%s: expected ErrTooDeep from ReadValue, got %v", name, err)
+		}
+		if err := NewReader(bytes.NewReader(value)).Skip(); err != ErrTooDeep {
+			t.Errorf("%s: expected ErrTooDeep from Skip, got %v", name, err)
+		}
+	}
+
+	value := nested(maxDepth, 0x91)
+	if _, err := NewReader(bytes.NewReader(value)).ReadValue(); err != nil {
+		t.Errorf("expected %d nested arrays to be read, got %v", maxDepth, err)
+	}
+	if err := NewReader(bytes.NewReader(value)).Skip(); err != nil {
+		t.Errorf("expected %d nested arrays to be skipped, got %v", maxDepth, err)
+	}
+}
+
+func TestReaderLimitsMessage(t *testing.T) {
+	// ["tag", "value"]
+	message := []byte{0x92, 0xa3, 't', 'a', 'g', 0xa5, 'v', 'a', 'l', 'u', 'e'}
+
+	reader := NewReader(bytes.NewReader(append(message, message...)))
+	for i := 0; i < 2; i++ {
+		reader.Limit(len(message))
+		v, err := reader.ReadValue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []interface{}{"tag", "value"}; !reflect.DeepEqual(v, expected) {
+			t.Fatalf("expected %v, got %v", expected, v)
+		}
+	}
+
+	reader = NewReader(bytes.NewReader(message))
+	reader.Limit(len(message) - 1)
+	if _, err := reader.ReadValue(); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package msgpack
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Writer encodes a msgpack stream value by value, with the same types as
+// the Reader. The errors are kept by the buffer and returned by Flush.
+type Writer struct {
+	w       *bufio.Writer
+	scratch [9]byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Reset discards the buffered data and writes to w
+func (writer *Writer) Reset(w io.Writer) {
+	writer.w.Reset(w)
+}
+
+// Flush writes the buffered data and returns the first error of the stream
+func (writer *Writer) Flush() error {
+	return writer.w.Flush()
+}
+
+// writeHeader writes a code followed by a big endian length of size bytes
+func (writer *Writer) writeHeader(c byte, size int, n uint64) {
+	writer.scratch[0] = c
+	switch size {
+	case 1:
+		writer.scratch[1] = byte(n)
+	case 2:
+		binary.BigEndian.PutUint16(writer.scratch[1:], uint16(n))
+	case 4:
+		binary.BigEndian.PutUint32(writer.scratch[1:], uint32(n))
+	case 8:
+		binary.BigEndian.PutUint64(writer.scratch[1:], n)
+	}
+	writer.w.Write(writer.scratch[:1+size])
+}
+
+// WriteArrayHeader writes the header of an array of n elements
+func (writer *Writer) WriteArrayHeader(n int) {
+	switch {
+	case n <= 0x0f:
+		writer.w.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		writer.writeHeader(0xdc, 2, uint64(n))
+	default:
+		writer.writeHeader(0xdd, 4, uint64(n))
+	}
+}
+
+// WriteMapHeader writes the header of a map of n key/value pairs
+func (writer *Writer) WriteMapHeader(n int) {
+	switch {
+	case n <= 0x0f:
+		writer.w.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		writer.writeHeader(0xde, 2, uint64(n))
+	default:
+		writer.writeHeader(0xdf, 4, uint64(n))
+	}
+}
+
+// WriteString writes a string
+func (writer *Writer) WriteString(s string) {
+	n := len(s)
+	switch {
+	case n <= 0x1f:
+		writer.w.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		writer.writeHeader(0xd9, 1, uint64(n))
+	case n <= math.MaxUint16:
+		writer.writeHeader(0xda, 2, uint64(n))
+	default:
+		writer.writeHeader(0xdb, 4, uint64(n))
+	}
+	writer.w.WriteString(s)
+}
+
+// WriteUint writes an unsigned integer in the smallest encoding
+func (writer *Writer) WriteUint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		writer.w.WriteByte(byte(v))
+	case v <= math.MaxUint8:
+		writer.writeHeader(0xcc, 1, v)
+	case v <= math.MaxUint16:
+		writer.writeHeader(0xcd, 2, v)
+	case v <= math.MaxUint32:
+		writer.writeHeader(0xce, 4, v)
+	default:
+		writer.writeHeader(0xcf, 8, v)
+	}
+}
@@ -0,0 +1,67 @@
+package msgpack
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriterRoundTrip(t *testing.T) {
+	strs := []string{"", "tag", strings.Repeat("a", 0x1f), strings.Repeat("b", 0x20), strings.Repeat("c", 300), strings.Repeat("d", 70000)}
+	uints := []uint64{0, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000, 0xffffffff, 0x100000000}
+
+	var buf bytes.Buffer
+	writer := NewWriter(&buf)
+	writer.WriteArrayHeader(len(strs))
+	for _, s := range strs {
+		writer.WriteString(s)
+	}
+	writer.WriteMapHeader(len(uints))
+	for _, u := range uints {
+		writer.WriteString("key")
+		writer.WriteUint(u)
+	}
+	writer.WriteArrayHeader(20)
+	for i := 0; i < 20; i++ {
+		writer.WriteUint(uint64(i))
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewReader(&buf)
+	v, err := reader.ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]interface{}, len(strs))
+	for i, s := range strs {
+		expected[i] = s
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Fatal("unexpected strings")
+	}
+
+	n, err := reader.ReadMapLen()
+	if err != nil || n != len(uints) {
+		t.Fatalf("expected a map of %d pairs, got %d (%v)", len(uints), n, err)
+	}
+	for _, u := range uints {
+		if err := reader.Skip(); err != nil {
+			t.Fatal(err)
+		}
+		v, err := reader.ReadValue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != u {
+			t.Fatalf("expected %d, got %v", u, v)
+		}
+	}
+
+	n, err = reader.ReadArrayLen()
+	if err != nil || n != 20 {
+		t.Fatalf("expected an array of 20 elements, got %d (%v)", n, err)
+	}
+}
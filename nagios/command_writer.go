@@ -0,0 +1,126 @@
+package nagios
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Delay before trying to open the command file again
+const commandFileRetryDelay = 1 * time.Second
+
+// CommandWriter writes external commands to the command file (named pipe)
+// of Nagios, Naemon or Icinga.
+type CommandWriter struct {
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	writerChan     chan string
+	isShuttingDown uintptr
+	commandFile    string
+	file           *os.File
+}
+
+func (writer *CommandWriter) open() error {
+	// Opening the pipe in non-blocking mode fails instead of waiting forever
+	// when nobody is reading the pipe.
+	file, err := os.OpenFile(writer.commandFile, os.O_WRONLY|os.O_APPEND|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	writer.file = file
+	return nil
+}
+
+func (writer *CommandWriter) close() {
+	if writer.file == nil {
+		return
+	}
+	if err := writer.file.Close(); err != nil {
+		writer.logger.Debugf("Close: %s", err.Error())
+	}
+	writer.file = nil
+}
+
+func (writer *CommandWriter) writeCommand(command string) error {
+	if writer.file == nil {
+		if err := writer.open(); err != nil {
+			return err
+		}
+		writer.logger.Infof("Opened command file %s", writer.commandFile)
+	}
+
+	if _, err := writer.file.Write([]byte(command)); err != nil {
+		writer.close()
+		return err
+	}
+	return nil
+}
+
+func (writer *CommandWriter) spawnWriter() {
+	writer.logger.Info("Spawning command writer")
+	writer.wg.Add(1)
+	go func() {
+		defer func() {
+			writer.close()
+			writer.wg.Done()
+		}()
+		writer.logger.Info("Command writer started")
+
+		for command := range writer.writerChan {
+			for {
+				err := writer.writeCommand(command)
+				if err == nil {
+					break
+				}
+				writer.logger.Error(err)
+				if atomic.LoadUintptr(&writer.isShuttingDown) != 0 {
+					break
+				}
+				time.Sleep(commandFileRetryDelay)
+			}
+		}
+		writer.logger.Info("Command writer ended")
+	}()
+}
+
+func (writer *CommandWriter) Emit(command string) error {
+	defer func() {
+		recover()
+	}()
+	writer.writerChan <- command
+	return nil
+}
+
+func (writer *CommandWriter) String() string {
+	return "command writer"
+}
+
+func (writer *CommandWriter) Stop() {
+	if atomic.CompareAndSwapUintptr(&writer.isShuttingDown, 0, 1) {
+		close(writer.writerChan)
+	}
+}
+
+func (writer *CommandWriter) WaitForShutdown() {
+	writer.wg.Wait()
+}
+
+func (writer *CommandWriter) Start() {
+	writer.spawnWriter()
+}
+
+func NewCommandWriter(logger *logrus.Logger, commandFile string) (*CommandWriter, error) {
+
+	writer := &CommandWriter{
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		writerChan:     make(chan string),
+		isShuttingDown: 0,
+		commandFile:    commandFile,
+	}
+	return writer, nil
+}
@@ -0,0 +1,149 @@
+package nagios
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+)
+
+// PerfdataWriter writes the perfdata lines to a hidden file of the perfdata directory,
+// which is renamed to be processed by PNP4Nagios or Graphios when it is rotated.
+type PerfdataWriter struct {
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	writerChan     chan string
+	isShuttingDown uintptr
+	config         config.Perfdata
+	file           *os.File
+	size           int64
+}
+
+func (writer *PerfdataWriter) open() error {
+	name := fmt.Sprintf(".%s.%d", writer.config.FilePrefix, time.Now().UnixNano())
+	file, err := os.OpenFile(filepath.Join(writer.config.PerfdataDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	writer.file = file
+	writer.size = 0
+	return nil
+}
+
+// rotate closes the current file and gives it its final name
+func (writer *PerfdataWriter) rotate() error {
+	if writer.file == nil {
+		return nil
+	}
+	file := writer.file
+	writer.file = nil
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	name := filepath.Base(file.Name())[1:]
+	return os.Rename(file.Name(), filepath.Join(writer.config.PerfdataDir, name))
+}
+
+func (writer *PerfdataWriter) write(line string) error {
+	if writer.file == nil {
+		if err := writer.open(); err != nil {
+			return err
+		}
+	}
+	n, err := writer.file.WriteString(line)
+	writer.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if writer.config.RotateSize > 0 && writer.size >= writer.config.RotateSize {
+		return writer.rotate()
+	}
+	return nil
+}
+
+func (writer *PerfdataWriter) spawnWriter() {
+	writer.logger.Info("Spawning perfdata writer")
+	writer.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(writer.config.RotateInterval)
+		defer func() {
+			ticker.Stop()
+			writer.wg.Done()
+		}()
+		writer.logger.Info("Perfdata writer started")
+
+	loop:
+		for {
+			select {
+			case line, ok := <-writer.writerChan:
+				if !ok {
+					break loop
+				}
+				// Check results without performance data give an empty line
+				if line == "" {
+					continue
+				}
+				if err := writer.write(line); err != nil {
+					writer.logger.Error(err)
+				}
+			case <-ticker.C:
+				if err := writer.rotate(); err != nil {
+					writer.logger.Error(err)
+				}
+			}
+		}
+
+		if err := writer.rotate(); err != nil {
+			writer.logger.Error(err)
+		}
+		writer.logger.Info("Perfdata writer ended")
+	}()
+}
+
+func (writer *PerfdataWriter) Emit(line string) error {
+	defer func() {
+		recover()
+	}()
+	writer.writerChan <- line
+	return nil
+}
+
+func (writer *PerfdataWriter) String() string {
+	return "perfdata writer"
+}
+
+func (writer *PerfdataWriter) Stop() {
+	if atomic.CompareAndSwapUintptr(&writer.isShuttingDown, 0, 1) {
+		close(writer.writerChan)
+	}
+}
+
+func (writer *PerfdataWriter) WaitForShutdown() {
+	writer.wg.Wait()
+}
+
+func (writer *PerfdataWriter) Start() {
+	writer.spawnWriter()
+}
+
+func NewPerfdataWriter(logger *logrus.Logger, _config config.Perfdata) (*PerfdataWriter, error) {
+	if err := os.MkdirAll(_config.PerfdataDir, 0755); err != nil {
+		return nil, err
+	}
+
+	writer := &PerfdataWriter{
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		writerChan:     make(chan string),
+		isShuttingDown: 0,
+		config:         _config,
+	}
+	return writer, nil
+}
@@ -0,0 +1,189 @@
+package nagios
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/MiLk/nmp/config"
+)
+
+// scanPendingFiles counts the check result files not reaped by Nagios yet
+func (writer *Writer) scanPendingFiles() ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(writer.config.CheckResultsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]os.FileInfo, 0, len(entries))
+	size := int64(0)
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || strings.HasSuffix(entry.Name(), ".ok") {
+			continue
+		}
+		pending = append(pending, entry)
+		size += entry.Size()
+	}
+
+	atomic.StoreInt64(&writer.pendingFiles, int64(len(pending)))
+	atomic.StoreInt64(&writer.pendingSize, size)
+	return pending, nil
+}
+
+func (writer *Writer) overQuota() bool {
+	if writer.config.MaxPendingFiles > 0 && atomic.LoadInt64(&writer.pendingFiles) >= writer.config.MaxPendingFiles {
+		return true
+	}
+	if writer.config.MaxPendingSize > 0 && atomic.LoadInt64(&writer.pendingSize) >= writer.config.MaxPendingSize {
+		return true
+	}
+	return false
+}
+
+func (writer *Writer) drop(count int) {
+	atomic.AddUint64(&writer.dropped, uint64(count))
+}
+
+// dropOldest removes the oldest pending files until the spool directory is below its quota
+func (writer *Writer) dropOldest() error {
+	pending, err := writer.scanPendingFiles()
+	if err != nil {
+		return err
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].ModTime().Before(pending[j].ModTime())
+	})
+
+	for _, entry := range pending {
+		if !writer.overQuota() {
+			break
+		}
+
+		filename := filepath.Join(writer.config.CheckResultsDir, entry.Name())
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			// Reaped in the meantime
+			continue
+		}
+
+		// Remove the .ok file first so Nagios does not read a file being removed
+		os.Remove(filename + ".ok")
+		if err := os.Remove(filename); err != nil {
+			continue
+		}
+		writer.drop(bytes.Count(content, []byte("\nhost_name=")))
+		atomic.AddInt64(&writer.pendingFiles, -1)
+		atomic.AddInt64(&writer.pendingSize, -entry.Size())
+	}
+	return nil
+}
+
+// coalesceKey identifies the host or service of a formatted check result
+func coalesceKey(checkResult string) string {
+	var hostname, service string
+	scanner := bufio.NewScanner(strings.NewReader(checkResult))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "host_name=") {
+			hostname = line[len("host_name="):]
+		} else if strings.HasPrefix(line, "service_description=") {
+			service = line[len("service_description="):]
+		}
+	}
+	return hostname + "/" + service
+}
+
+// coalesce keeps only the latest check result of every host and service
+func (writer *Writer) coalesce(checkResults []string) {
+	for _, checkResult := range checkResults {
+		key := coalesceKey(checkResult)
+		if _, ok := writer.coalesced[key]; ok {
+			writer.drop(1)
+		}
+		writer.coalesced[key] = checkResult
+	}
+}
+
+func (writer *Writer) drainCoalesced() []string {
+	checkResults := make([]string, 0, len(writer.coalesced))
+	for key, checkResult := range writer.coalesced {
+		checkResults = append(checkResults, checkResult)
+		delete(writer.coalesced, key)
+	}
+	return checkResults
+}
+
+// applyQuota returns the check results which can be written to the spool directory
+// according to its quota and overflow policy.
+func (writer *Writer) applyQuota(checkResults []string) []string {
+	if !writer.config.HasQuota() {
+		return checkResults
+	}
+
+	switch writer.config.OverflowPolicy {
+	case config.OverflowCoalesce:
+		if len(writer.coalesced) == 0 && !writer.overQuota() {
+			return checkResults
+		}
+		writer.coalesce(checkResults)
+		if writer.overQuota() {
+			return nil
+		}
+		return writer.drainCoalesced()
+	case config.OverflowDropOldest:
+		if writer.overQuota() {
+			if err := writer.dropOldest(); err != nil {
+				writer.logger.Error(err)
+			}
+		}
+		return checkResults
+	default:
+		if writer.overQuota() {
+			writer.drop(len(checkResults))
+			return nil
+		}
+		return checkResults
+	}
+}
+
+func (writer *Writer) spawnScanner(done chan struct{}) {
+	writer.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(writer.config.ScanInterval)
+		defer func() {
+			ticker.Stop()
+			writer.wg.Done()
+		}()
+
+		reported := uint64(0)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if _, err := writer.scanPendingFiles(); err != nil {
+				writer.logger.Error(err)
+			}
+
+			dropped := writer.Dropped()
+			if dropped > reported {
+				writer.logger.Warnf("%s is over quota (%d files, %d bytes pending), %d check results dropped so far",
+					writer.config.CheckResultsDir, atomic.LoadInt64(&writer.pendingFiles), atomic.LoadInt64(&writer.pendingSize), dropped)
+				reported = dropped
+			}
+		}
+	}()
+}
+
+// Dropped returns the number of check results dropped because the spool directory was over quota
+func (writer *Writer) Dropped() uint64 {
+	return atomic.LoadUint64(&writer.dropped)
+}
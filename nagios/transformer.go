@@ -2,6 +2,7 @@ package nagios
 
 import (
 	"bytes"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"text/template"
@@ -23,10 +24,33 @@ type Transformer struct {
 
 type TemplateData struct {
 	CheckResult shared.CheckResult
+	StartTime   int64
 	FinishTime  int64
+	Latency     float64
 	Date        string
 }
 
+func newTemplateData(check shared.CheckResult, now time.Time) TemplateData {
+	startTime := now.Unix()
+	if check.Timestamp > 0 {
+		startTime = int64(check.Timestamp)
+	}
+
+	// Samples from the future have no latency
+	latency := now.Sub(time.Unix(startTime, 0)).Seconds()
+	if latency < 0 {
+		latency = 0
+	}
+
+	return TemplateData{
+		CheckResult: check,
+		StartTime:   startTime,
+		FinishTime:  now.Unix(),
+		Latency:     latency,
+		Date:        now.Format("Mon Jan 02 15:04:05 -0700 2006"),
+	}
+}
+
 func (transformer *Transformer) spawnTransformer() {
 	transformer.logger.Info("Spawning transformer")
 	transformer.wg.Add(1)
@@ -40,12 +64,7 @@ func (transformer *Transformer) spawnTransformer() {
 		for checks := range transformer.transformerChan {
 			for _, check := range checks {
 				buf.Reset()
-				now := time.Now()
-				err := transformer.template.Execute(buf, TemplateData{
-					CheckResult: check,
-					FinishTime:  now.Unix(),
-					Date:        now.Format("Mon Jan 02 15:04:05 -0700 2006"),
-				})
+				err := transformer.template.Execute(buf, newTemplateData(check, time.Now()))
 				if err != nil {
 					transformer.logger.Error(err)
 					continue
@@ -83,11 +102,10 @@ func (transformer *Transformer) Start() {
 	transformer.spawnTransformer()
 }
 
-func NewTransformer(logger *logrus.Logger, writer shared.Writer) (*Transformer, error) {
-
-	checkTemplate := `### NMP Check ###
-latency=0
-start_time={{ .FinishTime }}.0
+// CheckResultTemplate formats a check result as a file of the check results spool directory
+const CheckResultTemplate = `### NMP Check ###
+latency={{ printf "%.3f" .Latency }}
+start_time={{ .StartTime }}.0
 finish_time={{ .FinishTime }}.0
 # Time: {{ .Date -}}
 {{ with .CheckResult }}
@@ -100,7 +118,40 @@ return_code={{ .Code }}
 output={{ .Output }}
 {{ end }}
 `
-	t, err := template.New("nagios writter").Parse(checkTemplate)
+
+// ExternalCommandTemplate formats a check result as a line of the external command file
+const ExternalCommandTemplate = `[{{ .FinishTime }}] {{ with .CheckResult -}}
+{{ if (eq .Type "service") -}}
+PROCESS_SERVICE_CHECK_RESULT;{{ .Hostname }};{{ .ServiceName }};{{ .Code }};{{ oneline .Output }}
+{{- else -}}
+PROCESS_HOST_CHECK_RESULT;{{ .Hostname }};{{ .Code }};{{ oneline .Output }}
+{{- end }}
+{{ end }}`
+
+// PerfdataTemplate formats the performance data of a service check result
+// as a line of the service perfdata file expected by PNP4Nagios
+const PerfdataTemplate = `{{ with .CheckResult }}{{ if and (eq .Type "service") .PerfData -}}
+DATATYPE::SERVICEPERFDATA	TIMET::{{ $.StartTime }}	HOSTNAME::{{ .Hostname }}	SERVICEDESC::{{ .ServiceName }}	SERVICEPERFDATA::{{ .PerfData }}	SERVICECHECKCOMMAND::nmp	HOSTSTATE::UP	HOSTSTATETYPE::HARD	SERVICESTATE::{{ state .Code }}	SERVICESTATETYPE::HARD	SERVICEOUTPUT::{{ oneline .Output }}
+{{ end }}{{ end }}`
+
+var states = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+var templateFuncs = template.FuncMap{
+	// oneline escapes the line breaks which would split a command in several ones
+	"oneline": func(s string) string {
+		return strings.Replace(s, "\n", `\n`, -1)
+	},
+	// state returns the name of a service state
+	"state": func(code uint8) string {
+		if int(code) < len(states) {
+			return states[code]
+		}
+		return states[3]
+	},
+}
+
+func NewTransformer(logger *logrus.Logger, checkTemplate string, writer shared.Writer) (*Transformer, error) {
+	t, err := template.New("nagios writter").Funcs(templateFuncs).Parse(checkTemplate)
 	if err != nil {
 		return nil, err
 	}
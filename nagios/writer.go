@@ -4,58 +4,135 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
 )
 
 type Writer struct {
-	logger          *logrus.Logger
-	wg              sync.WaitGroup
-	writerChan      chan string
-	isShuttingDown  uintptr
-	checkResultsDir string
+	dropped        uint64 // These variables must be on 64-bit alignment. Otherwise atomic.AddUint64 will cause a crash on ARM and x86-32
+	pendingFiles   int64
+	pendingSize    int64
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	writerChan     chan string
+	isShuttingDown uintptr
+	config         config.Spool
+	coalesced      map[string]string
 }
 
-func (writer *Writer) writeToFile(checkResult string) error {
-	tmpfile, err := TempFile(writer.checkResultsDir, "c", 6)
+func (writer *Writer) writeToFile(checkResults []byte) error {
+	tmpfile, err := TempFile(writer.config.CheckResultsDir, "c", 6)
 	if err != nil {
 		return err
 	}
-	if _, err := tmpfile.Write([]byte(checkResult)); err != nil {
+	if _, err := tmpfile.Write(checkResults); err != nil {
 		return err
 	}
 	if err := tmpfile.Close(); err != nil {
 		return err
 	}
-	if err := os.Chmod(tmpfile.Name(), 0770); err != nil {
+	if err := writer.setPermissions(tmpfile.Name()); err != nil {
 		return err
 	}
 
+	atomic.AddInt64(&writer.pendingFiles, 1)
+	atomic.AddInt64(&writer.pendingSize, int64(len(checkResults)))
+
 	filename := fmt.Sprintf("%s.ok", tmpfile.Name())
-	err = ioutil.WriteFile(filename, []byte{}, 0770)
+	err = ioutil.WriteFile(filename, []byte{}, writer.config.FileMode)
 	if err != nil {
 		return nil
 	}
+	if err := writer.setPermissions(filename); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+func (writer *Writer) setPermissions(filename string) error {
+	if err := os.Chmod(filename, writer.config.FileMode); err != nil {
+		return err
+	}
+	if writer.config.UID != -1 || writer.config.GID != -1 {
+		return os.Chown(filename, writer.config.UID, writer.config.GID)
+	}
+	return nil
+}
+
+func (writer *Writer) writeBatch(checkResults []string) {
+	checkResults = writer.applyQuota(checkResults)
+	for len(checkResults) > 0 {
+		n := len(checkResults)
+		if n > writer.config.MaxResultsPerFile {
+			n = writer.config.MaxResultsPerFile
+		}
+		if err := writer.writeToFile([]byte(strings.Join(checkResults[:n], ""))); err != nil {
+			writer.logger.Error(err)
+		}
+		checkResults = checkResults[n:]
+	}
+}
+
 func (writer *Writer) spawnWriter() {
 	writer.logger.Info("Spawning writer")
 	writer.wg.Add(1)
+	done := make(chan struct{})
+	if writer.config.HasQuota() {
+		if _, err := writer.scanPendingFiles(); err != nil {
+			writer.logger.Error(err)
+		}
+		writer.spawnScanner(done)
+	}
+
 	go func() {
 		defer func() {
+			close(done)
 			writer.wg.Done()
 		}()
 		writer.logger.Info("Writer started")
 
-		for checkResult := range writer.writerChan {
-			err := writer.writeToFile(checkResult)
-			if err != nil {
-				writer.logger.Error(err)
+		// Check results are separated by an empty line,
+		// so several of them can be written to the same file.
+		batch := make([]string, 0, writer.config.MaxResultsPerFile)
+		var flushChan <-chan time.Time
+		flush := func() {
+			if len(batch) == 0 {
+				return
 			}
+			writer.writeBatch(batch)
+			batch = batch[:0]
+			flushChan = nil
+		}
+
+	loop:
+		for {
+			select {
+			case checkResult, ok := <-writer.writerChan:
+				if !ok {
+					break loop
+				}
+				if len(batch) == 0 {
+					flushChan = time.After(writer.config.MaxFlushDelay)
+				}
+				batch = append(batch, checkResult)
+				if len(batch) >= writer.config.MaxResultsPerFile {
+					flush()
+				}
+			case <-flushChan:
+				flush()
+			}
+		}
+		flush()
+		if len(writer.coalesced) > 0 {
+			writer.logger.Warnf("Dropping %d coalesced check results", len(writer.coalesced))
+			writer.drop(len(writer.coalesced))
 		}
 		writer.logger.Info("Writer ended")
 	}()
@@ -87,14 +164,15 @@ func (writer *Writer) Start() {
 	writer.spawnWriter()
 }
 
-func NewWriter(logger *logrus.Logger, checkResultsDir string) (*Writer, error) {
+func NewWriter(logger *logrus.Logger, _config config.Spool) (*Writer, error) {
 
 	writer := &Writer{
-		logger:          logger,
-		wg:              sync.WaitGroup{},
-		writerChan:      make(chan string),
-		isShuttingDown:  0,
-		checkResultsDir: checkResultsDir,
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		writerChan:     make(chan string),
+		isShuttingDown: 0,
+		config:         _config,
+		coalesced:      map[string]string{},
 	}
 	return writer, nil
 }
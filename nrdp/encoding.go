@@ -0,0 +1,121 @@
+package nrdp
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+
+	"github.com/MiLk/nmp/shared"
+)
+
+// checkResultType returns the type of a check result as expected by NRDP
+func checkResultType(checkResult shared.CheckResult) string {
+	if checkResult.Type == "service" {
+		return "service"
+	}
+	return "host"
+}
+
+func formatState(code uint8) string {
+	return strconv.Itoa(int(code))
+}
+
+type xmlCheckResult struct {
+	XMLName     xml.Name `xml:"checkresult"`
+	Type        string   `xml:"type,attr"`
+	CheckType   string   `xml:"checktype,attr"`
+	Hostname    string   `xml:"hostname"`
+	ServiceName string   `xml:"servicename,omitempty"`
+	State       string   `xml:"state"`
+	Output      string   `xml:"output"`
+}
+
+type xmlCheckResults struct {
+	XMLName      xml.Name `xml:"checkresults"`
+	CheckResults []xmlCheckResult
+}
+
+func newXMLCheckResults(checkResults []shared.CheckResult) xmlCheckResults {
+	data := xmlCheckResults{CheckResults: make([]xmlCheckResult, len(checkResults))}
+	for i, checkResult := range checkResults {
+		data.CheckResults[i] = xmlCheckResult{
+			Type:        checkResultType(checkResult),
+			CheckType:   "1",
+			Hostname:    checkResult.Hostname,
+			ServiceName: checkResult.ServiceName,
+			State:       formatState(checkResult.Code),
+			Output:      checkResult.Output,
+		}
+		if checkResult.Type != "service" {
+			data.CheckResults[i].ServiceName = ""
+		}
+	}
+	return data
+}
+
+type jsonCheckResultType struct {
+	Type      string `json:"type"`
+	CheckType string `json:"checktype"`
+}
+
+type jsonCheckResult struct {
+	CheckResult jsonCheckResultType `json:"checkresult"`
+	Hostname    string              `json:"hostname"`
+	ServiceName string              `json:"servicename,omitempty"`
+	State       string              `json:"state"`
+	Output      string              `json:"output"`
+}
+
+type jsonCheckResults struct {
+	CheckResults []jsonCheckResult `json:"checkresults"`
+}
+
+func newJSONCheckResults(checkResults []shared.CheckResult) jsonCheckResults {
+	data := jsonCheckResults{CheckResults: make([]jsonCheckResult, len(checkResults))}
+	for i, checkResult := range checkResults {
+		data.CheckResults[i] = jsonCheckResult{
+			CheckResult: jsonCheckResultType{
+				Type:      checkResultType(checkResult),
+				CheckType: "1",
+			},
+			Hostname:    checkResult.Hostname,
+			ServiceName: checkResult.ServiceName,
+			State:       formatState(checkResult.Code),
+			Output:      checkResult.Output,
+		}
+		if checkResult.Type != "service" {
+			data.CheckResults[i].ServiceName = ""
+		}
+	}
+	return data
+}
+
+type result struct {
+	Status  int    `xml:"status" json:"status"`
+	Message string `xml:"message" json:"message"`
+}
+
+type jsonResponse struct {
+	Result result `json:"result"`
+}
+
+// checkResponse returns an error when the server rejected the submitted check results
+func checkResponse(format string, body []byte) error {
+	var r result
+	var err error
+	if format == "json" {
+		var response jsonResponse
+		err = json.Unmarshal(body, &response)
+		r = response.Result
+	} else {
+		err = xml.Unmarshal(body, &r)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid NRDP response: %s", err)
+	}
+	if r.Status != 0 {
+		return fmt.Errorf("NRDP server returned status %d: %s", r.Status, r.Message)
+	}
+	return nil
+}
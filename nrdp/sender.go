@@ -0,0 +1,191 @@
+package nrdp
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+// Sender submits the check results to a NRDP server by batches
+type Sender struct {
+	counters       *shared.Counters
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	queue          chan shared.CheckResult
+	done           chan struct{}
+	isShuttingDown uintptr
+	config         config.NRDP
+	client         *http.Client
+}
+
+func (sender *Sender) encode(checkResults []shared.CheckResult) (string, error) {
+	if sender.config.Format == "json" {
+		data, err := json.Marshal(newJSONCheckResults(checkResults))
+		return string(data), err
+	}
+	data, err := xml.Marshal(newXMLCheckResults(checkResults))
+	return xml.Header + string(data), err
+}
+
+func (sender *Sender) submit(data string) error {
+	form := url.Values{}
+	form.Set("token", sender.config.Token)
+	form.Set("cmd", "submitcheck")
+	if sender.config.Format == "json" {
+		form.Set("JSONDATA", data)
+	} else {
+		form.Set("XMLDATA", data)
+	}
+
+	resp, err := sender.client.PostForm(sender.config.URL, form)
+	if err != nil {
+		return shared.RetryableError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return shared.RetryableError{Err: err}
+	}
+
+	if resp.StatusCode >= 500 {
+		return shared.RetryableError{Err: fmt.Errorf("NRDP server returned %s", resp.Status)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("NRDP server returned %s", resp.Status)
+	}
+	return checkResponse(sender.config.Format, body)
+}
+
+func (sender *Sender) flush(batch []shared.CheckResult) {
+	data, err := sender.encode(batch)
+	if err != nil {
+		sender.logger.Error(err)
+		sender.counters.Add(shared.CounterFailed, len(batch))
+		return
+	}
+
+	backoff := shared.Backoff{Retries: sender.config.Retries, Delay: sender.config.RetryDelay, MaxDelay: sender.config.MaxRetryDelay}
+	if err := backoff.Retry(sender.logger, sender.counters, sender.done, func() error { return sender.submit(data) }); err == nil {
+		sender.counters.Add(shared.CounterSent, len(batch))
+		return
+	}
+
+	sender.counters.Add(shared.CounterFailed, len(batch))
+	sender.logger.Errorf("Failed to submit %d check results to %s", len(batch), sender.config.URL)
+}
+
+func (sender *Sender) spawnSender() {
+	sender.logger.Info("Spawning nrdp sender")
+	sender.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(sender.config.FlushInterval)
+		defer func() {
+			ticker.Stop()
+			sender.wg.Done()
+		}()
+		sender.logger.Info("NRDP sender started")
+
+		batch := make([]shared.CheckResult, 0, sender.config.BatchSize)
+	loop:
+		for {
+			select {
+			case checkResult, ok := <-sender.queue:
+				if !ok {
+					break loop
+				}
+				batch = append(batch, checkResult)
+				if len(batch) < sender.config.BatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			sender.flush(batch)
+			batch = batch[:0]
+		}
+
+		if len(batch) > 0 {
+			sender.flush(batch)
+		}
+		sender.logger.Info("NRDP sender ended")
+	}()
+}
+
+func (sender *Sender) Emit(checkResults []shared.CheckResult) error {
+	defer func() {
+		recover()
+	}()
+	for _, checkResult := range checkResults {
+		if sender.config.BlockQueue {
+			sender.queue <- checkResult
+			continue
+		}
+		select {
+		case sender.queue <- checkResult:
+		default:
+			sender.counters.Add(shared.CounterDropped, 1)
+			sender.logger.Warnf("NRDP queue is full, dropping %s - %s", checkResult.Hostname, checkResult.ServiceName)
+		}
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the counters of the sender
+func (sender *Sender) Stats() map[string]uint64 {
+	return sender.counters.Snapshot()
+}
+
+func (sender *Sender) String() string {
+	return "nrdp"
+}
+
+func (sender *Sender) Stop() {
+	if atomic.CompareAndSwapUintptr(&sender.isShuttingDown, 0, 1) {
+		close(sender.queue)
+		close(sender.done)
+	}
+}
+
+func (sender *Sender) WaitForShutdown() {
+	sender.wg.Wait()
+}
+
+func (sender *Sender) Start() {
+	sender.spawnSender()
+}
+
+func NewSender(logger *logrus.Logger, _config config.NRDP) (*Sender, error) {
+	tlsConfig, err := _config.TLS.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	sender := &Sender{
+		counters:       shared.NewCounters(shared.CounterSent, shared.CounterFailed, shared.CounterDropped, shared.CounterRetries),
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		queue:          make(chan shared.CheckResult, _config.QueueSize),
+		done:           make(chan struct{}),
+		isShuttingDown: 0,
+		config:         _config,
+		client: &http.Client{
+			Timeout:   _config.Timeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+	}
+	return sender, nil
+}
@@ -0,0 +1,165 @@
+package nsca
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/MiLk/nmp/shared"
+)
+
+const (
+	packetVersion     = 3
+	initPacketSize    = 132 // Initialization vector followed by the server timestamp
+	transmittedIVSize = 128
+	hostnameLength    = 64
+	descriptionLength = 128
+)
+
+// Encryption methods, as numbered in the nsca.cfg of the server
+const (
+	encryptNone        = 0
+	encryptXOR         = 1
+	encryptDES         = 2
+	encrypt3DES        = 3
+	encryptRijndael128 = 14
+)
+
+var encryptionMethods = map[string]int{
+	"none": encryptNone,
+	"xor":  encryptXOR,
+	"des":  encryptDES,
+	"3des": encrypt3DES,
+	"aes":  encryptRijndael128,
+}
+
+type encryptor interface {
+	encrypt(buf []byte)
+}
+
+type noneEncryptor struct{}
+
+func (e *noneEncryptor) encrypt(buf []byte) {}
+
+type xorEncryptor struct {
+	iv       []byte
+	password []byte
+}
+
+func (e *xorEncryptor) encrypt(buf []byte) {
+	for i := range buf {
+		buf[i] ^= e.iv[i%len(e.iv)]
+	}
+	if len(e.password) == 0 {
+		return
+	}
+	for i := range buf {
+		buf[i] ^= e.password[i%len(e.password)]
+	}
+}
+
+// cfb8Encryptor implements the 8-bit cipher feedback mode used by libmcrypt
+// for the "cfb" mode. The state is kept between packets of a same connection.
+type cfb8Encryptor struct {
+	block    cipher.Block
+	register []byte
+	out      []byte
+}
+
+func (e *cfb8Encryptor) encrypt(buf []byte) {
+	last := len(e.register) - 1
+	for i := range buf {
+		e.block.Encrypt(e.out, e.register)
+		buf[i] ^= e.out[0]
+		copy(e.register, e.register[1:])
+		e.register[last] = buf[i]
+	}
+}
+
+func newCFB8Encryptor(block cipher.Block, iv []byte) *cfb8Encryptor {
+	register := make([]byte, block.BlockSize())
+	copy(register, iv)
+	return &cfb8Encryptor{
+		block:    block,
+		register: register,
+		out:      make([]byte, block.BlockSize()),
+	}
+}
+
+// newEncryptor creates the encryptor of a connection from the
+// initialization vector sent by the server.
+func newEncryptor(method string, password string, iv []byte) (encryptor, error) {
+	var block cipher.Block
+	var err error
+	switch encryptionMethods[method] {
+	case encryptNone:
+		return &noneEncryptor{}, nil
+	case encryptXOR:
+		return &xorEncryptor{iv: iv, password: []byte(password)}, nil
+	case encryptDES:
+		block, err = des.NewCipher(cipherKey(password, 8))
+	case encrypt3DES:
+		block, err = des.NewTripleDESCipher(cipherKey(password, 24))
+	case encryptRijndael128:
+		block, err = aes.NewCipher(cipherKey(password, 32))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newCFB8Encryptor(block, iv), nil
+}
+
+// cipherKey pads or truncates the password to the key size of the cipher
+func cipherKey(password string, size int) []byte {
+	key := make([]byte, size)
+	copy(key, password)
+	return key
+}
+
+func validEncryption(method string) error {
+	if _, ok := encryptionMethods[method]; !ok {
+		return fmt.Errorf("Unsupported nsca encryption %q", method)
+	}
+	return nil
+}
+
+func packetSize(maxOutputLength int) int {
+	size := 14 + hostnameLength + descriptionLength + maxOutputLength
+	// Align the packet as the C struct of the server
+	return (size + 3) &^ 3
+}
+
+func putString(buf []byte, value string) {
+	n := copy(buf[:len(buf)-1], value)
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+}
+
+// encodePacket fills buf with the data packet of a check result
+func encodePacket(buf []byte, result shared.CheckResult, timestamp uint32, maxOutputLength int) {
+	// Random padding, as send_nsca does
+	rand.Read(buf)
+
+	binary.BigEndian.PutUint16(buf[0:], packetVersion)
+	binary.BigEndian.PutUint32(buf[4:], 0)
+	binary.BigEndian.PutUint32(buf[8:], timestamp)
+	binary.BigEndian.PutUint16(buf[12:], uint16(result.Code))
+
+	offset := 14
+	putString(buf[offset:offset+hostnameLength], result.Hostname)
+	offset += hostnameLength
+	if result.Type == "service" {
+		putString(buf[offset:offset+descriptionLength], result.ServiceName)
+	} else {
+		putString(buf[offset:offset+descriptionLength], "")
+	}
+	offset += descriptionLength
+	putString(buf[offset:offset+maxOutputLength], result.Output)
+
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(buf))
+}
@@ -0,0 +1,192 @@
+package nsca
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+type connection struct {
+	conn            net.Conn
+	encryptor       encryptor
+	serverTimestamp uint32
+	establishedAt   time.Time
+	lastUsed        time.Time
+}
+
+// timestamp returns the current time of the server, which rejects
+// the packets too far from its own clock.
+func (c *connection) timestamp() uint32 {
+	return c.serverTimestamp + uint32(time.Since(c.establishedAt)/time.Second)
+}
+
+// Sender sends the check results to a NSCA server through a pool of connections
+type Sender struct {
+	counters       *shared.Counters
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	queue          chan shared.CheckResult
+	done           chan struct{}
+	isShuttingDown uintptr
+	config         config.NSCA
+}
+
+func (sender *Sender) dial() (*connection, error) {
+	conn, err := net.DialTimeout("tcp", sender.config.Address, sender.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	initPacket := make([]byte, initPacketSize)
+	conn.SetReadDeadline(time.Now().Add(sender.config.Timeout))
+	if _, err := io.ReadFull(conn, initPacket); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	iv := initPacket[:transmittedIVSize]
+	_encryptor, err := newEncryptor(sender.config.Encryption, sender.config.Password, iv)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	now := time.Now()
+	return &connection{
+		conn:            conn,
+		encryptor:       _encryptor,
+		serverTimestamp: binary.BigEndian.Uint32(initPacket[transmittedIVSize:]),
+		establishedAt:   now,
+		lastUsed:        now,
+	}, nil
+}
+
+func (sender *Sender) send(c *connection, buf []byte, result shared.CheckResult) error {
+	encodePacket(buf, result, c.timestamp(), sender.config.MaxOutputLength)
+	c.encryptor.encrypt(buf)
+
+	c.conn.SetWriteDeadline(time.Now().Add(sender.config.Timeout))
+	if _, err := c.conn.Write(buf); err != nil {
+		return err
+	}
+	c.lastUsed = time.Now()
+	return nil
+}
+
+func (sender *Sender) spawnSender(id int) {
+	sender.logger.Infof("Spawning nsca sender %d", id)
+	sender.wg.Add(1)
+	go func() {
+		var c *connection
+		defer func() {
+			if c != nil {
+				c.conn.Close()
+			}
+			sender.wg.Done()
+		}()
+		sender.logger.Infof("NSCA sender %d started", id)
+
+		buf := make([]byte, packetSize(sender.config.MaxOutputLength))
+		backoff := shared.Backoff{Retries: sender.config.Retries, Delay: sender.config.RetryDelay}
+		for result := range sender.queue {
+			err := backoff.Retry(sender.logger, sender.counters, sender.done, func() error {
+				// The server may have closed an idle connection
+				if c != nil && time.Since(c.lastUsed) > sender.config.IdleTimeout {
+					c.conn.Close()
+					c = nil
+				}
+
+				if c == nil {
+					var err error
+					if c, err = sender.dial(); err != nil {
+						return shared.RetryableError{Err: err}
+					}
+				}
+
+				if err := sender.send(c, buf, result); err != nil {
+					c.conn.Close()
+					c = nil
+					return shared.RetryableError{Err: err}
+				}
+				return nil
+			})
+			if err != nil {
+				sender.counters.Add(shared.CounterFailed, 1)
+				sender.logger.Errorf("Failed to send %s - %s to %s", result.Hostname, result.ServiceName, sender.config.Address)
+				continue
+			}
+			sender.counters.Add(shared.CounterSent, 1)
+		}
+		sender.logger.Infof("NSCA sender %d ended", id)
+	}()
+}
+
+func (sender *Sender) Emit(checkResults []shared.CheckResult) error {
+	defer func() {
+		recover()
+	}()
+	for _, checkResult := range checkResults {
+		if sender.config.BlockQueue {
+			sender.queue <- checkResult
+			continue
+		}
+		select {
+		case sender.queue <- checkResult:
+		default:
+			sender.counters.Add(shared.CounterDropped, 1)
+			sender.logger.Warnf("NSCA queue is full, dropping %s - %s", checkResult.Hostname, checkResult.ServiceName)
+		}
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the counters of the sender
+func (sender *Sender) Stats() map[string]uint64 {
+	return sender.counters.Snapshot()
+}
+
+func (sender *Sender) String() string {
+	return "nsca"
+}
+
+func (sender *Sender) Stop() {
+	if atomic.CompareAndSwapUintptr(&sender.isShuttingDown, 0, 1) {
+		close(sender.queue)
+		close(sender.done)
+	}
+}
+
+func (sender *Sender) WaitForShutdown() {
+	sender.wg.Wait()
+}
+
+func (sender *Sender) Start() {
+	for i := 0; i < sender.config.Connections; i++ {
+		sender.spawnSender(i)
+	}
+}
+
+func NewSender(logger *logrus.Logger, _config config.NSCA) (*Sender, error) {
+	if err := validEncryption(_config.Encryption); err != nil {
+		return nil, err
+	}
+
+	sender := &Sender{
+		counters:       shared.NewCounters(shared.CounterSent, shared.CounterFailed, shared.CounterDropped, shared.CounterRetries),
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		queue:          make(chan shared.CheckResult, _config.QueueSize),
+		done:           make(chan struct{}),
+		isShuttingDown: 0,
+		config:         _config,
+	}
+	return sender, nil
+}
@@ -0,0 +1,175 @@
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/MiLk/nmp/config"
+)
+
+// KeyFunc identifies the items replacing each other with the coalesce policy
+type KeyFunc func(item interface{}) string
+
+// Buffer is a bounded queue between two stages of the pipeline.
+// When it is full, the overflow policy decides whether Push blocks
+// or which item is dropped.
+type Buffer struct {
+	dropped uint64 // This variable must be on 64-bit alignment. Otherwise atomic.AddUint64 will cause a crash on ARM and x86-32
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	items   []interface{}
+	size    int
+	policy  config.OverflowPolicy
+	key     KeyFunc
+	indexes map[string]uint64 // Sequence number of the latest queued item of every key, with the coalesce policy
+	popped  uint64            // Number of items removed from the head, the item at i has the sequence number popped+i
+	closed  bool
+	out     chan interface{}
+}
+
+// replace overwrites the queued item with the same key. mtx must be held.
+func (buffer *Buffer) replace(key string, item interface{}) bool {
+	seq, ok := buffer.indexes[key]
+	if !ok {
+		return false
+	}
+	buffer.items[seq-buffer.popped] = item
+	return true
+}
+
+// append queues an item at the tail. mtx must be held.
+func (buffer *Buffer) append(key string, item interface{}) {
+	if buffer.indexes != nil {
+		buffer.indexes[key] = buffer.popped + uint64(len(buffer.items))
+	}
+	buffer.items = append(buffer.items, item)
+}
+
+// shift removes the item at the head. mtx must be held.
+func (buffer *Buffer) shift() interface{} {
+	item := buffer.items[0]
+	buffer.items[0] = nil
+	buffer.items = buffer.items[1:]
+	if buffer.indexes != nil {
+		// The index only points to this item when no later one has the same key
+		if key := buffer.key(item); buffer.indexes[key] == buffer.popped {
+			delete(buffer.indexes, key)
+		}
+	}
+	buffer.popped++
+	return item
+}
+
+// Push queues an item. It returns false when the item, or another one, has been dropped.
+func (buffer *Buffer) Push(item interface{}) bool {
+	buffer.mtx.Lock()
+	defer buffer.mtx.Unlock()
+
+	if buffer.policy == config.OverflowBlock {
+		for len(buffer.items) >= buffer.size && !buffer.closed {
+			buffer.cond.Wait()
+		}
+	}
+	if buffer.closed {
+		atomic.AddUint64(&buffer.dropped, 1)
+		return false
+	}
+
+	var key string
+	if buffer.indexes != nil {
+		key = buffer.key(item)
+	}
+
+	if len(buffer.items) >= buffer.size {
+		atomic.AddUint64(&buffer.dropped, 1)
+		switch buffer.policy {
+		case config.OverflowCoalesce:
+			if buffer.replace(key, item) {
+				return false
+			}
+			buffer.shift()
+			buffer.append(key, item)
+		case config.OverflowDropOldest:
+			buffer.shift()
+			buffer.append(key, item)
+		}
+		return false
+	}
+
+	buffer.append(key, item)
+	buffer.cond.Broadcast()
+	return true
+}
+
+func (buffer *Buffer) pop() (interface{}, bool) {
+	buffer.mtx.Lock()
+	defer buffer.mtx.Unlock()
+	for len(buffer.items) == 0 && !buffer.closed {
+		buffer.cond.Wait()
+	}
+	if len(buffer.items) == 0 {
+		return nil, false
+	}
+
+	item := buffer.shift()
+	buffer.cond.Broadcast()
+	return item, true
+}
+
+// pump moves the items to the output channel, which is closed once the buffer is closed and empty
+func (buffer *Buffer) pump() {
+	for {
+		item, ok := buffer.pop()
+		if !ok {
+			close(buffer.out)
+			return
+		}
+		buffer.out <- item
+	}
+}
+
+// Out returns the channel to receive the items from
+func (buffer *Buffer) Out() <-chan interface{} {
+	return buffer.out
+}
+
+// Close stops accepting items, the queued ones can still be received
+func (buffer *Buffer) Close() {
+	buffer.mtx.Lock()
+	defer buffer.mtx.Unlock()
+	buffer.closed = true
+	buffer.cond.Broadcast()
+}
+
+// Len returns the number of queued items
+func (buffer *Buffer) Len() int {
+	buffer.mtx.Lock()
+	defer buffer.mtx.Unlock()
+	return len(buffer.items)
+}
+
+// Dropped returns the number of items dropped because the buffer was full
+func (buffer *Buffer) Dropped() uint64 {
+	return atomic.LoadUint64(&buffer.dropped)
+}
+
+func NewBuffer(_config config.Buffer, key KeyFunc) (*Buffer, error) {
+	if _config.OverflowPolicy == config.OverflowCoalesce && key == nil {
+		return nil, fmt.Errorf("The %s overflow policy requires the items to have a key", config.OverflowCoalesce)
+	}
+
+	buffer := &Buffer{
+		items:  make([]interface{}, 0, _config.Size),
+		size:   _config.Size,
+		policy: _config.OverflowPolicy,
+		key:    key,
+		out:    make(chan interface{}),
+	}
+	if _config.OverflowPolicy == config.OverflowCoalesce {
+		buffer.indexes = map[string]uint64{}
+	}
+	buffer.cond = sync.NewCond(&buffer.mtx)
+	go buffer.pump()
+	return buffer, nil
+}
@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/MiLk/nmp/config"
+)
+
+// firstLetter coalesces the items starting with the same letter
+func firstLetter(item interface{}) string {
+	return item.(string)[:1]
+}
+
+func newTestBuffer(t *testing.T, size int, policy config.OverflowPolicy) *Buffer {
+	buffer, err := NewBuffer(config.Buffer{Size: size, OverflowPolicy: policy}, firstLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer
+}
+
+// waitForLen waits until the buffer holds n items
+func waitForLen(t *testing.T, buffer *Buffer, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for buffer.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued items, got %d", n, buffer.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// drain closes the buffer and returns the items left
+func drain(buffer *Buffer) []interface{} {
+	buffer.Close()
+	items := []interface{}{}
+	for item := range buffer.Out() {
+		items = append(items, item)
+	}
+	return items
+}
+
+func TestBufferOverflowPolicies(t *testing.T) {
+	cases := []struct {
+		policy   config.OverflowPolicy
+		pushes   []string
+		expected []interface{}
+		dropped  uint64
+	}{
+		{config.OverflowDropNewest, []string{"a1", "b1", "c1", "d1", "e1"}, []interface{}{"x0", "a1", "b1", "c1"}, 2},
+		{config.OverflowDropOldest, []string{"a1", "b1", "c1", "d1", "e1"}, []interface{}{"x0", "c1", "d1", "e1"}, 2},
+		{config.OverflowCoalesce, []string{"a1", "b1", "c1", "a2"}, []interface{}{"x0", "a2", "b1", "c1"}, 1},
+		{config.OverflowCoalesce, []string{"a1", "b1", "a2", "c1", "b2", "d1", "b3"}, []interface{}{"x0", "c1", "d1", "b3"}, 4},
+	}
+	for _, c := range cases {
+		buffer := newTestBuffer(t, 3, c.policy)
+		// The first item waits in the output channel, the next ones fill the buffer
+		buffer.Push("x0")
+		waitForLen(t, buffer, 0)
+
+		refused := uint64(0)
+		for _, item := range c.pushes {
+			if !buffer.Push(item) {
+				refused++
+			}
+		}
+		if refused != c.dropped || buffer.Dropped() != c.dropped {
+			t.Errorf("%s %v: expected %d dropped items, got %d refused and %d dropped", c.policy, c.pushes, c.dropped, refused, buffer.Dropped())
+		}
+		if items := drain(buffer); fmt.Sprint(items) != fmt.Sprint(c.expected) {
+			t.Errorf("%s %v: expected %v, got %v", c.policy, c.pushes, c.expected, items)
+		}
+	}
+}
+
+func TestBufferBlocksUntilReceived(t *testing.T) {
+	buffer := newTestBuffer(t, 3, config.OverflowBlock)
+	buffer.Push("x0")
+	waitForLen(t, buffer, 0)
+	for _, item := range []string{"a1", "b1", "c1"} {
+		buffer.Push(item)
+	}
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- buffer.Push("d1")
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("expected Push to block while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if item := <-buffer.Out(); item != "x0" {
+		t.Fatalf("expected x0, got %v", item)
+	}
+	if !<-pushed {
+		t.Fatal("expected the blocked item to be queued")
+	}
+	if items, expected := drain(buffer), "[a1 b1 c1 d1]"; fmt.Sprint(items) != expected {
+		t.Errorf("expected %s, got %v", expected, items)
+	}
+	if buffer.Dropped() != 0 {
+		t.Errorf("expected no dropped item, got %d", buffer.Dropped())
+	}
+}
+
+func TestBufferPushAfterClose(t *testing.T) {
+	for _, policy := range []config.OverflowPolicy{config.OverflowBlock, config.OverflowDropNewest, config.OverflowDropOldest, config.OverflowCoalesce} {
+		buffer := newTestBuffer(t, 3, policy)
+		buffer.Push("a1")
+		buffer.Close()
+		if buffer.Push("b1") {
+			t.Errorf("%s: expected Push to fail once closed", policy)
+		}
+		if buffer.Dropped() != 1 {
+			t.Errorf("%s: expected 1 dropped item, got %d", policy, buffer.Dropped())
+		}
+		if items := drain(buffer); fmt.Sprint(items) != "[a1]" {
+			t.Errorf("%s: expected the queued items to be received, got %v", policy, items)
+		}
+	}
+}
+
+func TestBufferCoalesceRequiresKey(t *testing.T) {
+	if _, err := NewBuffer(config.Buffer{Size: 3, OverflowPolicy: config.OverflowCoalesce}, nil); err == nil {
+		t.Fatal("expected an error without key")
+	}
+}
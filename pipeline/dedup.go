@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MiLk/nmp/shared"
+)
+
+type dedupState struct {
+	code     uint8
+	lastEmit time.Time
+}
+
+// Deduplicator forwards a check result only when its code changed
+// or when the refresh interval elapsed since the last forwarded result
+// of the same host and service.
+type Deduplicator struct {
+	mtx             sync.Mutex
+	states          map[string]dedupState
+	refreshInterval time.Duration
+	transformer     shared.Transformer
+}
+
+func (dedup *Deduplicator) filter(checkResults []shared.CheckResult) []shared.CheckResult {
+	dedup.mtx.Lock()
+	defer dedup.mtx.Unlock()
+
+	now := time.Now()
+	filtered := make([]shared.CheckResult, 0, len(checkResults))
+	for _, checkResult := range checkResults {
+		key := checkResult.Hostname + "/" + checkResult.ServiceName
+		state, ok := dedup.states[key]
+		if ok && state.code == checkResult.Code && now.Sub(state.lastEmit) < dedup.refreshInterval {
+			continue
+		}
+		dedup.states[key] = dedupState{code: checkResult.Code, lastEmit: now}
+		filtered = append(filtered, checkResult)
+	}
+	return filtered
+}
+
+func (dedup *Deduplicator) Emit(checkResults []shared.CheckResult) error {
+	filtered := dedup.filter(checkResults)
+	if len(filtered) == 0 {
+		return nil
+	}
+	return dedup.transformer.Emit(filtered)
+}
+
+func NewDeduplicator(refreshInterval time.Duration, transformer shared.Transformer) (*Deduplicator, error) {
+	return &Deduplicator{
+		mtx:             sync.Mutex{},
+		states:          map[string]dedupState{},
+		refreshInterval: refreshInterval,
+		transformer:     transformer,
+	}, nil
+}
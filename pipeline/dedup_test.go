@@ -0,0 +1,34 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MiLk/nmp/shared"
+)
+
+func TestDeduplicatorForwardsChanges(t *testing.T) {
+	output := newTestOutput()
+	dedup, err := NewDeduplicator(time.Hour, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches := [][]shared.CheckResult{
+		{{Hostname: "a", ServiceName: "load", Code: 0}, {Hostname: "b", ServiceName: "load", Code: 0}},
+		{{Hostname: "a", ServiceName: "load", Code: 0}},
+		{{Hostname: "a", ServiceName: "load", Code: 2}, {Hostname: "a", ServiceName: "disk", Code: 0}},
+		{{Hostname: "b", ServiceName: "load", Code: 0}},
+	}
+	for _, checkResults := range batches {
+		if err := dedup.Emit(checkResults); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output.waitForHostnames(t, "a", "b", "a", "a")
+
+	// The unchanged check results are forwarded again after the refresh interval
+	dedup.refreshInterval = 0
+	dedup.Emit(batches[1])
+	output.waitForHostnames(t, "a", "b", "a", "a", "a")
+}
@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+// Filter selects the check results sent to an output
+type Filter struct {
+	hosts    *regexp.Regexp
+	services *regexp.Regexp
+	codes    map[uint8]bool
+}
+
+func (filter *Filter) Match(checkResult shared.CheckResult) bool {
+	if filter.hosts != nil && !filter.hosts.MatchString(checkResult.Hostname) {
+		return false
+	}
+	if filter.services != nil && !filter.services.MatchString(checkResult.ServiceName) {
+		return false
+	}
+	if len(filter.codes) > 0 && !filter.codes[checkResult.Code] {
+		return false
+	}
+	return true
+}
+
+func NewFilter(output config.Output) Filter {
+	codes := map[uint8]bool{}
+	for _, code := range output.Codes {
+		codes[uint8(code)] = true
+	}
+	return Filter{
+		hosts:    output.Hosts,
+		services: output.Services,
+		codes:    codes,
+	}
+}
+
+// maxBatchSize limits the number of queued check results sent at once to an output
+const maxBatchSize = 100
+
+// CheckResultKey identifies the host and service of a check result, to coalesce them
+func CheckResultKey(item interface{}) string {
+	checkResult := item.(shared.CheckResult)
+	return checkResult.Hostname + "/" + checkResult.ServiceName
+}
+
+type branch struct {
+	name   string
+	filter Filter
+	output shared.Transformer
+	buffer *Buffer
+}
+
+// FanOut sends the check results to several outputs.
+// Every output has its own queue so a slow or failing output does not block the others.
+type FanOut struct {
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	branches       []*branch
+	isShuttingDown uintptr
+}
+
+// Add registers an output. It must be called before Start.
+func (fanOut *FanOut) Add(name string, filter Filter, output shared.Transformer, buffer config.Buffer) error {
+	checkResults, err := NewBuffer(buffer, CheckResultKey)
+	if err != nil {
+		return err
+	}
+	fanOut.branches = append(fanOut.branches, &branch{
+		name:   name,
+		filter: filter,
+		output: output,
+		buffer: checkResults,
+	})
+	return nil
+}
+
+func (fanOut *FanOut) spawnBranch(b *branch) {
+	fanOut.logger.Infof("Spawning fan-out to %s", b.name)
+	fanOut.wg.Add(1)
+	go func() {
+		defer func() {
+			fanOut.wg.Done()
+		}()
+		fanOut.logger.Infof("Fan-out to %s started", b.name)
+
+		out := b.buffer.Out()
+		for item := range out {
+			checkResults := []shared.CheckResult{item.(shared.CheckResult)}
+		batch:
+			for len(checkResults) < maxBatchSize {
+				select {
+				case item, ok := <-out:
+					if !ok {
+						break batch
+					}
+					checkResults = append(checkResults, item.(shared.CheckResult))
+				default:
+					break batch
+				}
+			}
+
+			if err := b.output.Emit(checkResults); err != nil {
+				fanOut.logger.Error(err)
+			}
+		}
+		fanOut.logger.Infof("Fan-out to %s ended", b.name)
+	}()
+}
+
+// Emit returns an error when check results have been dropped for an output
+func (fanOut *FanOut) Emit(checkResults []shared.CheckResult) (err error) {
+	defer func() {
+		recover()
+	}()
+	for _, b := range fanOut.branches {
+		for _, checkResult := range checkResults {
+			if !b.filter.Match(checkResult) {
+				continue
+			}
+			if !b.buffer.Push(checkResult) {
+				fanOut.logger.Warnf("Output %s is not keeping up, dropping check results", b.name)
+				err = fmt.Errorf("Output %s dropped check results", b.name)
+			}
+		}
+	}
+	return err
+}
+
+// Dropped returns the number of check results dropped for each output
+func (fanOut *FanOut) Dropped() map[string]uint64 {
+	dropped := map[string]uint64{}
+	for _, b := range fanOut.branches {
+		dropped[b.name] = b.buffer.Dropped()
+	}
+	return dropped
+}
+
+func (fanOut *FanOut) String() string {
+	return "fan-out"
+}
+
+func (fanOut *FanOut) Stop() {
+	if atomic.CompareAndSwapUintptr(&fanOut.isShuttingDown, 0, 1) {
+		for _, b := range fanOut.branches {
+			b.buffer.Close()
+		}
+	}
+}
+
+func (fanOut *FanOut) WaitForShutdown() {
+	fanOut.wg.Wait()
+}
+
+func (fanOut *FanOut) Start() {
+	for _, b := range fanOut.branches {
+		fanOut.spawnBranch(b)
+	}
+}
+
+func NewFanOut(logger *logrus.Logger) (*FanOut, error) {
+	return &FanOut{
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		isShuttingDown: 0,
+	}, nil
+}
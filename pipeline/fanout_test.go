@@ -0,0 +1,48 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+func TestFanOutReturnsDroppedOutputs(t *testing.T) {
+	fanOut, err := NewFanOut(newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, slow, critical := newTestOutput(), newTestOutput(), newTestOutput()
+	fanOut.Add("all", NewFilter(config.Output{}), all, config.Buffer{Size: 10, OverflowPolicy: config.OverflowDropNewest})
+	fanOut.Add("slow", NewFilter(config.Output{}), slow, config.Buffer{Size: 1, OverflowPolicy: config.OverflowDropNewest})
+	fanOut.Add("critical", NewFilter(config.Output{Codes: []int{2}}), critical, config.Buffer{Size: 10, OverflowPolicy: config.OverflowDropNewest})
+
+	if err := fanOut.Emit([]shared.CheckResult{{Hostname: "a", Code: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	// The branches are not started, the first check result waits in the output channel
+	for _, b := range fanOut.branches {
+		waitForLen(t, b.buffer, 0)
+	}
+
+	err = fanOut.Emit([]shared.CheckResult{{Hostname: "b"}, {Hostname: "c", Code: 2}})
+	if err == nil || !strings.Contains(err.Error(), "slow") {
+		t.Fatalf("expected an error for the slow output, got %v", err)
+	}
+	dropped := fanOut.Dropped()
+	if dropped["all"] != 0 || dropped["slow"] != 1 || dropped["critical"] != 0 {
+		t.Fatalf("expected 1 check result dropped for the slow output, got %v", dropped)
+	}
+
+	fanOut.Start()
+	fanOut.Stop()
+	fanOut.WaitForShutdown()
+	all.waitForHostnames(t, "a", "b", "c")
+	slow.waitForHostnames(t, "a", "b")
+	critical.waitForHostnames(t, "a", "c")
+
+	if err := fanOut.Emit([]shared.CheckResult{{Hostname: "d"}}); err == nil {
+		t.Fatal("expected an error once stopped")
+	}
+}
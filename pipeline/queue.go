@@ -0,0 +1,499 @@
+package pipeline
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+const (
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+	// Every record starts with the length and the CRC32 of its payload
+	recordHeaderSize   = 8
+	cursorSaveInterval = time.Second
+	retentionInterval  = time.Minute
+	retryInterval      = time.Second
+)
+
+var errCorruptedRecord = errors.New("Corrupted record")
+
+// position is the location of the next record to forward
+type position struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// Queue persists the check results in segment files before forwarding them,
+// so the check results not forwarded yet are replayed after a restart.
+// Every batch of check results is a record of the segment being written,
+// the segments are removed once forwarded or when they exceed the retention.
+type Queue struct {
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	isShuttingDown uintptr
+	config         config.Queue
+	next           shared.Transformer
+	notify         chan struct{}
+	done           chan struct{}
+
+	mtx       sync.Mutex // Protects the fields below, shared by Emit, the reader and the retention
+	segments  []segment  // Oldest first, the last one is being written when writeFile is set
+	writeFile *os.File
+	cursor    position
+	closed    bool
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentSuffix)
+}
+
+func (queue *Queue) segmentPath(seq uint64) string {
+	return filepath.Join(queue.config.Dir, segmentName(seq))
+}
+
+// load lists the existing segments and reads the position of the reader
+func (queue *Queue) load() error {
+	entries, err := ioutil.ReadDir(queue.config.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		queue.segments = append(queue.segments, segment{seq: seq, size: entry.Size()})
+	}
+	sort.Slice(queue.segments, func(i, j int) bool {
+		return queue.segments[i].seq < queue.segments[j].seq
+	})
+
+	data, err := ioutil.ReadFile(filepath.Join(queue.config.Dir, cursorFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &queue.cursor); err != nil {
+			queue.logger.Errorf("Invalid queue cursor, replaying all the segments: %s", err)
+			queue.cursor = position{}
+		}
+	}
+
+	// Remove the segments already forwarded
+	for len(queue.segments) > 0 && queue.segments[0].seq < queue.cursor.Segment {
+		os.Remove(queue.segmentPath(queue.segments[0].seq))
+		queue.segments = queue.segments[1:]
+	}
+	// The segment of the cursor is missing, start from the beginning of the next one
+	if len(queue.segments) == 0 || queue.segments[0].seq > queue.cursor.Segment {
+		queue.cursor.Offset = 0
+		if len(queue.segments) > 0 {
+			queue.cursor.Segment = queue.segments[0].seq
+		}
+	}
+	if len(queue.segments) > 0 {
+		queue.logger.Infof("Replaying %d queue segments from %s", len(queue.segments), queue.config.Dir)
+	}
+	return nil
+}
+
+func (queue *Queue) saveCursor(cursor position) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(queue.config.Dir, cursorFile+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(queue.config.Dir, cursorFile))
+}
+
+// rollover closes the segment being written and creates a new one. mtx must be held.
+func (queue *Queue) rollover() error {
+	if queue.writeFile != nil {
+		queue.writeFile.Close()
+		queue.writeFile = nil
+	}
+
+	seq := queue.cursor.Segment
+	if len(queue.segments) > 0 {
+		seq = queue.segments[len(queue.segments)-1].seq + 1
+	}
+	file, err := os.OpenFile(queue.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	queue.writeFile = file
+	queue.segments = append(queue.segments, segment{seq: seq})
+	return nil
+}
+
+// remove deletes the oldest segment. mtx must be held.
+func (queue *Queue) remove() {
+	seq := queue.segments[0].seq
+	if err := os.Remove(queue.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+		queue.logger.Error(err)
+	}
+	queue.segments = queue.segments[1:]
+	if queue.cursor.Segment <= seq {
+		queue.cursor = position{Segment: seq + 1}
+	}
+}
+
+// enforceMaxSize removes the oldest segments, forwarded or not, while the queue is too large. mtx must be held.
+func (queue *Queue) enforceMaxSize() {
+	if queue.config.MaxSize <= 0 {
+		return
+	}
+	total := int64(0)
+	for _, s := range queue.segments {
+		total += s.size
+	}
+	for total > queue.config.MaxSize && len(queue.segments) > 1 {
+		if queue.segments[0].seq >= queue.cursor.Segment {
+			queue.logger.Warnf("Queue %s is over max_size, dropping segment %d", queue.config.Dir, queue.segments[0].seq)
+		}
+		total -= queue.segments[0].size
+		queue.remove()
+	}
+}
+
+func (queue *Queue) write(payload []byte) error {
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	queue.mtx.Lock()
+	defer queue.mtx.Unlock()
+	if queue.closed {
+		return errors.New("Queue is closed")
+	}
+
+	if queue.writeFile == nil || queue.segments[len(queue.segments)-1].size >= queue.config.SegmentSize {
+		if err := queue.rollover(); err != nil {
+			return err
+		}
+	}
+	n, err := queue.writeFile.Write(record)
+	queue.segments[len(queue.segments)-1].size += int64(n)
+	if err != nil {
+		// Do not append after a partial record
+		queue.writeFile.Close()
+		queue.writeFile = nil
+		return err
+	}
+	if queue.config.Sync {
+		if err := queue.writeFile.Sync(); err != nil {
+			return err
+		}
+	}
+	queue.enforceMaxSize()
+	return nil
+}
+
+func (queue *Queue) Emit(checkResults []shared.CheckResult) error {
+	payload, err := json.Marshal(checkResults)
+	if err != nil {
+		return err
+	}
+	if err := queue.write(payload); err != nil {
+		queue.logger.Error(err)
+		return err
+	}
+
+	select {
+	case queue.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// readRecord reads the record at offset, io.EOF or io.ErrUnexpectedEOF are returned
+// at the end of the segment or when the record is not completely written.
+func readRecord(file *os.File, offset int64) ([]shared.CheckResult, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	// Also protects against a corrupted length
+	if offset+recordHeaderSize+int64(length) > info.Size() {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorruptedRecord
+	}
+
+	var checkResults []shared.CheckResult
+	if err := json.Unmarshal(payload, &checkResults); err != nil {
+		return nil, 0, errCorruptedRecord
+	}
+	return checkResults, offset + recordHeaderSize + int64(length), nil
+}
+
+// current returns the position of the reader, and whether its segment is being written
+func (queue *Queue) current() (position, bool, bool) {
+	queue.mtx.Lock()
+	defer queue.mtx.Unlock()
+	if len(queue.segments) == 0 {
+		return queue.cursor, false, false
+	}
+	if queue.cursor.Segment < queue.segments[0].seq {
+		queue.cursor = position{Segment: queue.segments[0].seq}
+	}
+	if queue.cursor.Segment > queue.segments[len(queue.segments)-1].seq {
+		return queue.cursor, false, false
+	}
+	live := queue.writeFile != nil && queue.cursor.Segment == queue.segments[len(queue.segments)-1].seq
+	return queue.cursor, live, true
+}
+
+// advance moves the reader after a forwarded record, unless the retention moved it meanwhile
+func (queue *Queue) advance(from position, offset int64) {
+	queue.mtx.Lock()
+	defer queue.mtx.Unlock()
+	if queue.cursor == from {
+		queue.cursor.Offset = offset
+	}
+}
+
+// finish removes the segment completely forwarded by the reader
+func (queue *Queue) finish(seq uint64) {
+	queue.mtx.Lock()
+	defer queue.mtx.Unlock()
+	if len(queue.segments) > 0 && queue.segments[0].seq == seq {
+		queue.remove()
+	} else if queue.cursor.Segment == seq {
+		queue.cursor = position{Segment: seq + 1}
+	}
+}
+
+func (queue *Queue) wait() bool {
+	select {
+	case <-queue.notify:
+		return true
+	case <-queue.done:
+		return false
+	}
+}
+
+// retry waits before forwarding a record again
+func (queue *Queue) retry() {
+	select {
+	case <-time.After(retryInterval):
+	case <-queue.done:
+	}
+}
+
+func (queue *Queue) spawnReader() {
+	queue.logger.Info("Spawning queue reader")
+	queue.wg.Add(1)
+	go func() {
+		var file *os.File
+		lastSave := time.Now()
+		defer func() {
+			if file != nil {
+				file.Close()
+			}
+			queue.mtx.Lock()
+			queue.closed = true
+			if queue.writeFile != nil {
+				queue.writeFile.Close()
+				queue.writeFile = nil
+			}
+			cursor := queue.cursor
+			queue.mtx.Unlock()
+			if err := queue.saveCursor(cursor); err != nil {
+				queue.logger.Error(err)
+			}
+			queue.wg.Done()
+		}()
+		queue.logger.Info("Queue reader started")
+
+		for {
+			select {
+			case <-queue.done:
+				queue.logger.Info("Queue reader ended")
+				return
+			default:
+			}
+
+			pos, live, ok := queue.current()
+			if !ok {
+				queue.wait()
+				continue
+			}
+
+			path := queue.segmentPath(pos.Segment)
+			if file == nil || file.Name() != path {
+				if file != nil {
+					file.Close()
+				}
+				var err error
+				if file, err = os.Open(path); err != nil {
+					queue.logger.Error(err)
+					file = nil
+					queue.finish(pos.Segment)
+					continue
+				}
+			}
+
+			checkResults, offset, err := readRecord(file, pos.Offset)
+			switch {
+			case err == nil:
+				// The record is read again when the outputs did not accept all of it
+				if err := queue.next.Emit(checkResults); err != nil {
+					queue.logger.Error(err)
+					queue.retry()
+					continue
+				}
+				queue.advance(pos, offset)
+			case live && (err == io.EOF || err == io.ErrUnexpectedEOF):
+				queue.wait()
+			default:
+				if err != io.EOF {
+					queue.logger.Errorf("Skipping the end of queue segment %s: %s", path, err)
+				}
+				if live {
+					// Write the next records to a new segment
+					queue.mtx.Lock()
+					if err := queue.rollover(); err != nil {
+						queue.logger.Error(err)
+					}
+					queue.mtx.Unlock()
+				}
+				file.Close()
+				file = nil
+				queue.finish(pos.Segment)
+			}
+
+			if time.Since(lastSave) >= cursorSaveInterval {
+				queue.mtx.Lock()
+				cursor := queue.cursor
+				queue.mtx.Unlock()
+				if err := queue.saveCursor(cursor); err != nil {
+					queue.logger.Error(err)
+				}
+				lastSave = time.Now()
+			}
+		}
+	}()
+}
+
+// spawnRetention removes the segments older than the retention, forwarded or not
+func (queue *Queue) spawnRetention() {
+	queue.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(retentionInterval)
+		defer func() {
+			ticker.Stop()
+			queue.wg.Done()
+		}()
+
+		for {
+			select {
+			case <-queue.done:
+				return
+			case <-ticker.C:
+			}
+
+			queue.expire()
+		}
+	}()
+}
+
+// expire removes the segments older than the retention, except the last one
+func (queue *Queue) expire() {
+	queue.mtx.Lock()
+	defer queue.mtx.Unlock()
+	for len(queue.segments) > 1 {
+		info, err := os.Stat(queue.segmentPath(queue.segments[0].seq))
+		if err == nil && time.Since(info.ModTime()) < queue.config.Retention {
+			break
+		}
+		if queue.segments[0].seq >= queue.cursor.Segment {
+			queue.logger.Warnf("Queue segment %d exceeded the retention, dropping it", queue.segments[0].seq)
+		}
+		queue.remove()
+	}
+}
+
+func (queue *Queue) String() string {
+	return "queue"
+}
+
+func (queue *Queue) Stop() {
+	if atomic.CompareAndSwapUintptr(&queue.isShuttingDown, 0, 1) {
+		close(queue.done)
+	}
+}
+
+func (queue *Queue) WaitForShutdown() {
+	queue.wg.Wait()
+}
+
+func (queue *Queue) Start() {
+	queue.spawnReader()
+	if queue.config.Retention > 0 {
+		queue.spawnRetention()
+	}
+}
+
+func NewQueue(logger *logrus.Logger, _config config.Queue, next shared.Transformer) (*Queue, error) {
+	if err := os.MkdirAll(_config.Dir, 0750); err != nil {
+		return nil, err
+	}
+
+	queue := &Queue{
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		isShuttingDown: 0,
+		config:         _config,
+		next:           next,
+		notify:         make(chan struct{}, 1),
+		done:           make(chan struct{}),
+	}
+	if err := queue.load(); err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
@@ -0,0 +1,240 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+// testOutput records the check results it accepts
+type testOutput struct {
+	mtx      sync.Mutex
+	results  []shared.CheckResult
+	failing  bool
+	received chan struct{}
+	release  chan struct{} // Emit waits until it is closed when set
+}
+
+func newTestOutput() *testOutput {
+	return &testOutput{received: make(chan struct{}, 100)}
+}
+
+func (output *testOutput) Emit(checkResults []shared.CheckResult) error {
+	if output.release != nil {
+		output.received <- struct{}{}
+		<-output.release
+	}
+	output.mtx.Lock()
+	defer output.mtx.Unlock()
+	if output.failing {
+		return errors.New("output is down")
+	}
+	output.results = append(output.results, checkResults...)
+	return nil
+}
+
+func (output *testOutput) hostnames() []string {
+	output.mtx.Lock()
+	defer output.mtx.Unlock()
+	hostnames := []string{}
+	for _, checkResult := range output.results {
+		hostnames = append(hostnames, checkResult.Hostname)
+	}
+	return hostnames
+}
+
+// waitForHostnames waits until the output received the check results of the hostnames
+func (output *testOutput) waitForHostnames(t *testing.T, expected ...string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hostnames := output.hostnames()
+		if fmt.Sprint(hostnames) == fmt.Sprint(expected) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the check results of %v, got %v", expected, hostnames)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logger
+}
+
+func newTestQueue(t *testing.T, _config config.Queue, next shared.Transformer) *Queue {
+	queue, err := NewQueue(newTestLogger(), _config, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Start()
+	return queue
+}
+
+func stopQueue(queue *Queue) {
+	queue.Stop()
+	queue.WaitForShutdown()
+}
+
+func emitHosts(t *testing.T, queue *Queue, hostnames ...string) {
+	for _, hostname := range hostnames {
+		if err := queue.Emit([]shared.CheckResult{{Hostname: hostname}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestQueueReplaysAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_config := config.Queue{Dir: dir, SegmentSize: 1 << 20}
+
+	down := newTestOutput()
+	down.failing = true
+	queue := newTestQueue(t, _config, down)
+	emitHosts(t, queue, "a", "b")
+	stopQueue(queue)
+	if hostnames := down.hostnames(); len(hostnames) != 0 {
+		t.Fatalf("expected nothing to be forwarded, got %v", hostnames)
+	}
+
+	output := newTestOutput()
+	queue = newTestQueue(t, _config, output)
+	output.waitForHostnames(t, "a", "b")
+	emitHosts(t, queue, "c")
+	output.waitForHostnames(t, "a", "b", "c")
+	stopQueue(queue)
+
+	// The cursor was saved, the forwarded check results are not replayed
+	output = newTestOutput()
+	queue = newTestQueue(t, _config, output)
+	emitHosts(t, queue, "d")
+	output.waitForHostnames(t, "d")
+	stopQueue(queue)
+}
+
+func TestQueueSkipsCorruptedSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Every record is written to a new segment
+	_config := config.Queue{Dir: dir, SegmentSize: 1}
+
+	down := newTestOutput()
+	down.failing = true
+	queue := newTestQueue(t, _config, down)
+	emitHosts(t, queue, "a", "b", "c", "d")
+	stopQueue(queue)
+
+	files := segmentFiles(t, dir)
+	if len(files) != 4 {
+		t.Fatalf("expected 4 segments, got %v", files)
+	}
+	// Corrupt the payload of the first segment
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-2] ^= 0xff
+	if err := ioutil.WriteFile(files[0], data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	// Truncated tails: a partial header, then a record longer than the segment
+	for i, tail := range [][]byte{{0x10, 0x00}, {0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, '['}} {
+		file, err := os.OpenFile(files[i+1], os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(tail)
+		file.Close()
+	}
+
+	output := newTestOutput()
+	queue = newTestQueue(t, _config, output)
+	output.waitForHostnames(t, "b", "c", "d")
+	stopQueue(queue)
+}
+
+func TestQueueRetentionMovesTheBusyReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_config := config.Queue{Dir: dir, SegmentSize: 1, Retention: time.Hour}
+
+	output := newTestOutput()
+	output.release = make(chan struct{})
+	queue := newTestQueue(t, _config, output)
+	emitHosts(t, queue, "a", "b", "c")
+
+	// The reader is forwarding a while the first segments expire
+	select {
+	case <-output.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the reader to forward the first segment")
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, file := range segmentFiles(t, dir)[:2] {
+		if err := os.Chtimes(file, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue.expire()
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected the expired segments to be removed, got %v", files)
+	}
+
+	// b expired, the reader continues with c
+	close(output.release)
+	output.waitForHostnames(t, "a", "c")
+	stopQueue(queue)
+}
+
+func TestQueueMaxSizeDropsTheOldestSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_config := config.Queue{Dir: dir, SegmentSize: 1, MaxSize: 1}
+
+	down := newTestOutput()
+	down.failing = true
+	queue := newTestQueue(t, _config, down)
+	emitHosts(t, queue, "a", "b", "c")
+	stopQueue(queue)
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected only the last segment to be kept, got %v", files)
+	}
+
+	output := newTestOutput()
+	queue = newTestQueue(t, _config, output)
+	output.waitForHostnames(t, "c")
+	stopQueue(queue)
+}
@@ -0,0 +1,230 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+type metric struct {
+	name string
+	help string
+}
+
+var (
+	metricValue      = metric{"nmp_check_value", "Last value evaluated by the check."}
+	metricCode       = metric{"nmp_check_code", "Last return code of the check (0 OK, 1 WARNING, 2 CRITICAL, 3 UNKNOWN)."}
+	metricWarning    = metric{"nmp_check_warning_threshold", "Warning threshold applied on the last value."}
+	metricCritical   = metric{"nmp_check_critical_threshold", "Critical threshold applied on the last value."}
+	metricLastUpdate = metric{"nmp_check_last_update_timestamp_seconds", "Timestamp of the last result of the check."}
+	metricDropped    = metric{"nmp_dropped_total", "Number of items dropped by a stage of the pipeline."}
+	metricOutput     = metric{"nmp_output_total", "Counters of the outputs, such as the sent, failed, dropped and retried check results."}
+)
+
+type checkState struct {
+	hostname   string
+	checkType  string
+	service    string
+	code       uint8
+	value      string
+	warning    string
+	critical   string
+	lastUpdate uint64
+	received   time.Time
+}
+
+// Exporter keeps the last result of every check and exposes them to Prometheus
+type Exporter struct {
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	mutex          sync.Mutex
+	states         map[string]checkState
+	isShuttingDown uintptr
+	config         config.Prometheus
+	server         *http.Server
+	listener       net.Listener
+	stats          *shared.StatsRegistry
+}
+
+func (exporter *Exporter) Emit(checkResults []shared.CheckResult) error {
+	received := time.Now()
+	now := uint64(received.Unix())
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	for _, checkResult := range checkResults {
+		state := checkState{
+			hostname:   checkResult.Hostname,
+			checkType:  checkResult.Type,
+			service:    checkResult.ServiceName,
+			code:       checkResult.Code,
+			value:      checkResult.Value,
+			warning:    checkResult.Warning,
+			critical:   checkResult.Critical,
+			lastUpdate: checkResult.Timestamp,
+			received:   received,
+		}
+		if state.lastUpdate == 0 {
+			state.lastUpdate = now
+		}
+		exporter.states[checkResult.Hostname+"/"+checkResult.ServiceName] = state
+	}
+	return nil
+}
+
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+// writeMetric writes one metric family in the Prometheus text format.
+// Samples whose value is not a number are skipped.
+func writeMetric(buf *bytes.Buffer, m metric, states []checkState, value func(checkState) string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+	for _, state := range states {
+		v := value(state)
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			continue
+		}
+		fmt.Fprintf(buf, "%s{hostname=\"%s\",service=\"%s\",type=\"%s\"} %s\n",
+			m.name, escapeLabel(state.hostname), escapeLabel(state.service), escapeLabel(state.checkType), v)
+	}
+}
+
+// snapshot returns the states sorted by host and service,
+// after dropping the ones which have not been updated for a while
+func (exporter *Exporter) snapshot() []checkState {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	states := make([]checkState, 0, len(exporter.states))
+	for key, state := range exporter.states {
+		if exporter.config.StaleAfter > 0 && time.Since(state.received) > exporter.config.StaleAfter {
+			delete(exporter.states, key)
+			continue
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].hostname != states[j].hostname {
+			return states[i].hostname < states[j].hostname
+		}
+		return states[i].service < states[j].service
+	})
+	return states
+}
+
+// writeOutputStats writes the counters of the outputs
+func writeOutputStats(buf *bytes.Buffer, outputs []shared.OutputStats) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", metricOutput.name, metricOutput.help, metricOutput.name)
+	for _, output := range outputs {
+		names := make([]string, 0, len(output.Counters))
+		for name := range output.Counters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(buf, "%s{counter=\"%s\",output=\"%s\",type=\"%s\"} %d\n",
+				metricOutput.name, name, escapeLabel(output.Name), output.Type, output.Counters[name])
+		}
+	}
+}
+
+// writeStageStats writes the number of items dropped by the stages
+func writeStageStats(buf *bytes.Buffer, stages []shared.StageStats) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", metricDropped.name, metricDropped.help, metricDropped.name)
+	for _, stage := range stages {
+		if stage.Output == "" {
+			fmt.Fprintf(buf, "%s{stage=\"%s\"} %d\n", metricDropped.name, stage.Stage, stage.Dropped)
+			continue
+		}
+		fmt.Fprintf(buf, "%s{output=\"%s\",stage=\"%s\"} %d\n", metricDropped.name, escapeLabel(stage.Output), stage.Stage, stage.Dropped)
+	}
+}
+
+func (exporter *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	states := exporter.snapshot()
+
+	var buf bytes.Buffer
+	writeMetric(&buf, metricValue, states, func(state checkState) string { return state.value })
+	writeMetric(&buf, metricCode, states, func(state checkState) string { return strconv.Itoa(int(state.code)) })
+	writeMetric(&buf, metricWarning, states, func(state checkState) string { return state.warning })
+	writeMetric(&buf, metricCritical, states, func(state checkState) string { return state.critical })
+	writeMetric(&buf, metricLastUpdate, states, func(state checkState) string { return strconv.FormatUint(state.lastUpdate, 10) })
+	writeOutputStats(&buf, exporter.stats.Outputs())
+	writeStageStats(&buf, exporter.stats.Stages())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (exporter *Exporter) String() string {
+	return "prometheus"
+}
+
+func (exporter *Exporter) Stop() {
+	if atomic.CompareAndSwapUintptr(&exporter.isShuttingDown, 0, 1) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := exporter.server.Shutdown(ctx); err != nil {
+			exporter.logger.Error(err)
+		}
+	}
+}
+
+func (exporter *Exporter) WaitForShutdown() {
+	exporter.wg.Wait()
+}
+
+func (exporter *Exporter) Start() {
+	exporter.logger.Infof("Spawning prometheus exporter on %s%s", exporter.config.Listen, exporter.config.MetricsPath)
+	exporter.wg.Add(1)
+	go func() {
+		defer func() {
+			exporter.wg.Done()
+		}()
+		exporter.logger.Info("Prometheus exporter started")
+		if err := exporter.server.Serve(exporter.listener); err != nil && err != http.ErrServerClosed {
+			exporter.logger.Error(err)
+		}
+		exporter.logger.Info("Prometheus exporter ended")
+	}()
+}
+
+func NewExporter(logger *logrus.Logger, _config config.Prometheus, stats *shared.StatsRegistry) (*Exporter, error) {
+	listener, err := net.Listen("tcp", _config.Listen)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+
+	exporter := &Exporter{
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		states:         map[string]checkState{},
+		isShuttingDown: 0,
+		config:         _config,
+		listener:       listener,
+		stats:          stats,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(_config.MetricsPath, exporter)
+	exporter.server = &http.Server{
+		Addr:    _config.Listen,
+		Handler: mux,
+	}
+	return exporter, nil
+}
@@ -0,0 +1,53 @@
+package shared
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// RetryableError is returned when the request can be sent again
+type RetryableError struct {
+	Err error
+}
+
+func (e RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+// Backoff sends a request again after a retryable error. The delay doubles
+// after every attempt up to MaxDelay, it stays constant when MaxDelay is lower.
+type Backoff struct {
+	Retries  int
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// Retry calls send until it succeeds, returns an error which is not retryable,
+// there are no retries left or done is closed. It returns the last error.
+func (backoff Backoff) Retry(logger *logrus.Logger, counters *Counters, done <-chan struct{}, send func() error) error {
+	delay := backoff.Delay
+	for attempt := 0; ; attempt++ {
+		err := send()
+		if err == nil {
+			return nil
+		}
+		logger.Error(err)
+
+		if _, ok := err.(RetryableError); !ok || attempt >= backoff.Retries {
+			return err
+		}
+
+		select {
+		case <-done:
+			return err
+		case <-time.After(delay):
+		}
+		counters.Add(CounterRetries, 1)
+		if next := 2 * delay; next <= backoff.MaxDelay {
+			delay = next
+		} else if delay < backoff.MaxDelay {
+			delay = backoff.MaxDelay
+		}
+	}
+}
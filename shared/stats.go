@@ -0,0 +1,120 @@
+package shared
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Names of the counters shared by the outputs
+const (
+	CounterSent    = "sent"    // Check results accepted by the destination
+	CounterFailed  = "failed"  // Check results dropped after the last retry
+	CounterDropped = "dropped" // Check results dropped because the queue was full
+	CounterRetries = "retries" // Requests sent again after a failure
+)
+
+// Counters counts the check results handled by an output.
+// They can be updated and read concurrently.
+type Counters struct {
+	values map[string]*uint64
+}
+
+// StatsReporter is implemented by the outputs keeping counters
+type StatsReporter interface {
+	Stats() map[string]uint64
+}
+
+// Add increments a counter, which must be one of the names given to NewCounters
+func (counters *Counters) Add(name string, n int) {
+	atomic.AddUint64(counters.values[name], uint64(n))
+}
+
+// Snapshot returns the current value of every counter
+func (counters *Counters) Snapshot() map[string]uint64 {
+	snapshot := make(map[string]uint64, len(counters.values))
+	for name, value := range counters.values {
+		snapshot[name] = atomic.LoadUint64(value)
+	}
+	return snapshot
+}
+
+func NewCounters(names ...string) *Counters {
+	counters := &Counters{values: make(map[string]*uint64, len(names))}
+	for _, name := range names {
+		counters.values[name] = new(uint64)
+	}
+	return counters
+}
+
+// OutputStats are the counters of an output
+type OutputStats struct {
+	Name     string
+	Type     string
+	Counters map[string]uint64
+}
+
+// StageStats is the number of items dropped by a stage of the pipeline,
+// for one output when the stage has one buffer per output
+type StageStats struct {
+	Stage   string
+	Output  string
+	Dropped uint64
+}
+
+type registeredOutput struct {
+	name       string
+	outputType string
+	reporter   StatsReporter
+}
+
+type registeredStage struct {
+	stage   string
+	output  string
+	dropped func() uint64
+}
+
+// StatsRegistry collects the counters of the outputs and the stages,
+// they are read every time they are exposed
+type StatsRegistry struct {
+	mtx     sync.Mutex
+	outputs []registeredOutput
+	stages  []registeredStage
+}
+
+func (registry *StatsRegistry) AddOutput(name string, outputType string, reporter StatsReporter) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	registry.outputs = append(registry.outputs, registeredOutput{name: name, outputType: outputType, reporter: reporter})
+}
+
+// Outputs returns the current counters of the outputs, in the order they have been added
+func (registry *StatsRegistry) Outputs() []OutputStats {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	stats := make([]OutputStats, 0, len(registry.outputs))
+	for _, output := range registry.outputs {
+		stats = append(stats, OutputStats{Name: output.name, Type: output.outputType, Counters: output.reporter.Stats()})
+	}
+	return stats
+}
+
+func (registry *StatsRegistry) AddStage(stage string, output string, dropped func() uint64) {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	registry.stages = append(registry.stages, registeredStage{stage: stage, output: output, dropped: dropped})
+}
+
+// Stages returns the current number of dropped items of the stages, in the order they have been added
+func (registry *StatsRegistry) Stages() []StageStats {
+	registry.mtx.Lock()
+	defer registry.mtx.Unlock()
+	stats := make([]StageStats, 0, len(registry.stages))
+	for _, stage := range registry.stages {
+		stats = append(stats, StageStats{Stage: stage.stage, Output: stage.output, Dropped: stage.dropped()})
+	}
+	return stats
+}
+
+func NewStatsRegistry() *StatsRegistry {
+	return &StatsRegistry{}
+}
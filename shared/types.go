@@ -1,5 +1,13 @@
 package shared
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/MiLk/nmp/msgpack"
+)
+
 type TinyRecord struct {
 	Timestamp uint64
 	Data      map[string]interface{}
@@ -14,12 +22,40 @@ type InputListener interface {
 	Emit(recordSets []RecordSet) error
 }
 
+// RecordDecoder is an InputListener which decodes the records straight
+// from the msgpack stream instead of receiving them as generic maps
+type RecordDecoder interface {
+	InputListener
+	NewRecordStream() RecordStream
+}
+
+// RecordStream decodes the records received on one connection
+type RecordStream interface {
+	// Decode reads the record of an entry
+	Decode(reader *msgpack.Reader, tag string, timestamp uint64) error
+	// Flush emits the records decoded since the last call
+	Flush() error
+}
+
 type CheckResult struct {
 	Hostname    string
 	Type        string
 	ServiceName string
 	Code        uint8
 	Output      string
+	Timestamp   uint64 // Timestamp of the sample which produced the result
+	Value       string // Evaluated value, empty when the result does not come from a threshold
+	Warning     string
+	Critical    string
+}
+
+// PerfData returns the evaluated value and its thresholds
+// in the performance data format of the Nagios plugins.
+func (result CheckResult) PerfData() string {
+	if _, err := strconv.ParseFloat(result.Value, 64); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("'%s'=%s;%s;%s;;", strings.Replace(result.ServiceName, "'", "''", -1), result.Value, result.Warning, result.Critical)
 }
 
 type Transformer interface {
@@ -7,6 +7,7 @@ import (
 
 type SignalHandler struct {
 	Workers    *WorkerSet
+	stages     [][]Worker
 	signalChan chan os.Signal
 }
 
@@ -14,15 +15,32 @@ func (handler *SignalHandler) Start() {
 	signal.Notify(handler.signalChan, os.Kill, os.Interrupt)
 	go func() {
 		<-handler.signalChan
+		// The stages are drained one after the other,
+		// so the next ones receive their last items before stopping
+		stopped := map[Worker]bool{}
+		for _, stage := range handler.stages {
+			for _, worker := range stage {
+				worker.Stop()
+				stopped[worker] = true
+			}
+			for _, worker := range stage {
+				worker.WaitForShutdown()
+			}
+		}
 		for _, worker := range handler.Workers.Slice() {
-			worker.Stop()
+			if !stopped[worker] {
+				worker.Stop()
+			}
 		}
 	}()
 }
 
-func NewSignalHandler(workerSet *WorkerSet) *SignalHandler {
+// NewSignalHandler stops the stages of workers in the given order, then the other workers of the set.
+// The workers of a stage are stopped together, and the next stage once they all shut down.
+func NewSignalHandler(workerSet *WorkerSet, stages ...[]Worker) *SignalHandler {
 	return &SignalHandler{
 		workerSet,
+		stages,
 		make(chan os.Signal, 1),
 	}
 }
@@ -0,0 +1,336 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+// DefaultTemplate sends the template data as a JSON object
+const DefaultTemplate = "{{ json . }}"
+
+var states = map[uint8]string{
+	0: "OK",
+	1: "WARNING",
+	2: "CRITICAL",
+	3: "UNKNOWN",
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// CounterDeadLetter counts the failed requests written to the dead-letter file
+const CounterDeadLetter = "dead_letter"
+
+// TemplateData is given to the body and headers templates
+type TemplateData struct {
+	Hostname      string `json:"hostname"`
+	Type          string `json:"type"`
+	ServiceName   string `json:"service"`
+	Code          uint8  `json:"code"`
+	State         string `json:"state"`
+	PreviousCode  int    `json:"previous_code"` // -1 for the first result of a host or service
+	PreviousState string `json:"previous_state"`
+	Output        string `json:"output"`
+	Value         string `json:"value,omitempty"`
+	Warning       string `json:"warning,omitempty"`
+	Critical      string `json:"critical,omitempty"`
+	Timestamp     uint64 `json:"timestamp"`
+}
+
+type request struct {
+	body    []byte
+	headers map[string]string
+}
+
+// deadLetter is a line of the dead-letter file
+type deadLetter struct {
+	Time    time.Time         `json:"time"`
+	URL     string            `json:"url"`
+	Error   string            `json:"error"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// Sender sends the check results to a HTTP endpoint, with a body and headers rendered from templates
+type Sender struct {
+	counters       *shared.Counters
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	queue          chan shared.CheckResult
+	done           chan struct{}
+	isShuttingDown uintptr
+	config         config.Webhook
+	client         *http.Client
+	body           *template.Template
+	headers        map[string]*template.Template
+	codes          map[string]uint8
+}
+
+func newTemplateData(checkResult shared.CheckResult, previousCode int) TemplateData {
+	timestamp := checkResult.Timestamp
+	if timestamp == 0 {
+		timestamp = uint64(time.Now().Unix())
+	}
+	data := TemplateData{
+		Hostname:     checkResult.Hostname,
+		Type:         checkResult.Type,
+		ServiceName:  checkResult.ServiceName,
+		Code:         checkResult.Code,
+		State:        states[checkResult.Code],
+		PreviousCode: previousCode,
+		Output:       checkResult.Output,
+		Value:        checkResult.Value,
+		Warning:      checkResult.Warning,
+		Critical:     checkResult.Critical,
+		Timestamp:    timestamp,
+	}
+	if previousCode >= 0 {
+		data.PreviousState = states[uint8(previousCode)]
+	}
+	return data
+}
+
+// changed tracks the code of every host and service,
+// and returns the previous code when the check result must be sent
+func (sender *Sender) changed(checkResult shared.CheckResult) (int, bool) {
+	key := checkResult.Hostname + "/" + checkResult.ServiceName
+	previous, ok := sender.codes[key]
+	sender.codes[key] = checkResult.Code
+
+	previousCode := -1
+	if ok {
+		previousCode = int(previous)
+	}
+	if sender.config.Mode == config.WebhookAll {
+		return previousCode, true
+	}
+	// The first result of a host or service is only sent when it is not OK
+	if !ok {
+		return previousCode, checkResult.Code != 0
+	}
+	return previousCode, previous != checkResult.Code
+}
+
+func (sender *Sender) render(data TemplateData) (request, error) {
+	var buf bytes.Buffer
+	if err := sender.body.Execute(&buf, data); err != nil {
+		return request{}, err
+	}
+	req := request{
+		body:    buf.Bytes(),
+		headers: make(map[string]string, len(sender.headers)+1),
+	}
+	for name, tpl := range sender.headers {
+		var value bytes.Buffer
+		if err := tpl.Execute(&value, data); err != nil {
+			return request{}, err
+		}
+		req.headers[name] = value.String()
+	}
+	if sender.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(sender.config.Secret))
+		mac.Write(req.body)
+		req.headers[sender.config.SignatureHeader] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return req, nil
+}
+
+func (sender *Sender) post(req request) error {
+	httpReq, err := http.NewRequest(sender.config.Method, sender.config.URL, bytes.NewReader(req.body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	for name, value := range req.headers {
+		httpReq.Header.Set(name, value)
+	}
+
+	resp, err := sender.client.Do(httpReq)
+	if err != nil {
+		return shared.RetryableError{Err: err}
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return shared.RetryableError{Err: fmt.Errorf("Webhook %s returned %s: %s", sender.config.URL, resp.Status, body)}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook %s returned %s: %s", sender.config.URL, resp.Status, body)
+	}
+	return nil
+}
+
+func (sender *Sender) writeDeadLetter(req request, reason error) error {
+	if sender.config.DeadLetterFile == "" {
+		return nil
+	}
+	line, err := json.Marshal(deadLetter{
+		Time:    time.Now(),
+		URL:     sender.config.URL,
+		Error:   reason.Error(),
+		Headers: req.headers,
+		Body:    string(req.body),
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(sender.config.DeadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	sender.counters.Add(CounterDeadLetter, 1)
+	return f.Close()
+}
+
+func (sender *Sender) send(checkResult shared.CheckResult) {
+	previousCode, ok := sender.changed(checkResult)
+	if !ok {
+		return
+	}
+
+	req, err := sender.render(newTemplateData(checkResult, previousCode))
+	if err != nil {
+		sender.logger.Error(err)
+		sender.counters.Add(shared.CounterFailed, 1)
+		return
+	}
+
+	backoff := shared.Backoff{Retries: sender.config.Retries, Delay: sender.config.RetryDelay, MaxDelay: sender.config.MaxRetryDelay}
+	err = backoff.Retry(sender.logger, sender.counters, sender.done, func() error { return sender.post(req) })
+	if err == nil {
+		sender.counters.Add(shared.CounterSent, 1)
+		return
+	}
+
+	sender.counters.Add(shared.CounterFailed, 1)
+	sender.logger.Errorf("Failed to send %s - %s to %s", checkResult.Hostname, checkResult.ServiceName, sender.config.URL)
+	if err := sender.writeDeadLetter(req, err); err != nil {
+		sender.logger.Error(err)
+	}
+}
+
+func (sender *Sender) spawnSender() {
+	sender.logger.Info("Spawning webhook sender")
+	sender.wg.Add(1)
+	go func() {
+		defer func() {
+			sender.wg.Done()
+		}()
+		sender.logger.Info("Webhook sender started")
+
+		for checkResult := range sender.queue {
+			sender.send(checkResult)
+		}
+		sender.logger.Info("Webhook sender ended")
+	}()
+}
+
+func (sender *Sender) Emit(checkResults []shared.CheckResult) error {
+	defer func() {
+		recover()
+	}()
+	for _, checkResult := range checkResults {
+		if sender.config.BlockQueue {
+			sender.queue <- checkResult
+			continue
+		}
+		select {
+		case sender.queue <- checkResult:
+		default:
+			sender.counters.Add(shared.CounterDropped, 1)
+			sender.logger.Warnf("Webhook queue is full, dropping %s - %s", checkResult.Hostname, checkResult.ServiceName)
+		}
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the counters of the sender
+func (sender *Sender) Stats() map[string]uint64 {
+	return sender.counters.Snapshot()
+}
+
+func (sender *Sender) String() string {
+	return "webhook"
+}
+
+func (sender *Sender) Stop() {
+	if atomic.CompareAndSwapUintptr(&sender.isShuttingDown, 0, 1) {
+		close(sender.queue)
+		close(sender.done)
+	}
+}
+
+func (sender *Sender) WaitForShutdown() {
+	sender.wg.Wait()
+}
+
+func (sender *Sender) Start() {
+	sender.spawnSender()
+}
+
+func NewSender(logger *logrus.Logger, _config config.Webhook) (*Sender, error) {
+	tlsConfig, err := _config.TLS.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	bodyTemplate := _config.Template
+	if bodyTemplate == "" {
+		bodyTemplate = DefaultTemplate
+	}
+	body, err := template.New("body").Funcs(templateFuncs).Parse(bodyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]*template.Template, len(_config.Headers))
+	for name, value := range _config.Headers {
+		if headers[name], err = template.New(name).Funcs(templateFuncs).Parse(value); err != nil {
+			return nil, err
+		}
+	}
+
+	sender := &Sender{
+		counters:       shared.NewCounters(shared.CounterSent, shared.CounterFailed, shared.CounterDropped, shared.CounterRetries, CounterDeadLetter),
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		queue:          make(chan shared.CheckResult, _config.QueueSize),
+		done:           make(chan struct{}),
+		isShuttingDown: 0,
+		config:         _config,
+		client: &http.Client{
+			Timeout:   _config.Timeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+		body:    body,
+		headers: headers,
+		codes:   map[string]uint8{},
+	}
+	return sender, nil
+}
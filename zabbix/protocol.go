@@ -0,0 +1,87 @@
+package zabbix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+var header = []byte("ZBXD\x01")
+
+// maxResponseSize protects against a peer which is not a Zabbix server
+const maxResponseSize = 1 << 20
+
+type item struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock uint64 `json:"clock"`
+}
+
+type senderData struct {
+	Request string `json:"request"`
+	Data    []item `json:"data"`
+	Clock   int64  `json:"clock"`
+}
+
+type response struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+var infoFailed = regexp.MustCompile(`failed: (\d+)`)
+
+// failed returns the number of items rejected by the server, usually because the item does not exist
+func (r response) failed() int {
+	match := infoFailed.FindStringSubmatch(r.Info)
+	if match == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(match[1])
+	return n
+}
+
+// encode frames the request with the header and the data length of the Zabbix protocol
+func encode(request interface{}) ([]byte, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(header)
+	binary.Write(&buf, binary.LittleEndian, uint64(len(data)))
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+func decode(r io.Reader) (response, error) {
+	var resp response
+	prefix := make([]byte, len(header)+8)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return resp, err
+	}
+	if !bytes.Equal(prefix[:len(header)], header) {
+		return resp, fmt.Errorf("Invalid Zabbix response header %q", prefix[:len(header)])
+	}
+
+	length := binary.LittleEndian.Uint64(prefix[len(header):])
+	if length > maxResponseSize {
+		return resp, fmt.Errorf("Zabbix response too large (%d bytes)", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return resp, err
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return resp, err
+	}
+	if resp.Response != "success" {
+		return resp, fmt.Errorf("Zabbix server returned %q: %s", resp.Response, resp.Info)
+	}
+	return resp, nil
+}
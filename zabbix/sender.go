@@ -0,0 +1,230 @@
+package zabbix
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/MiLk/nmp/config"
+	"github.com/MiLk/nmp/shared"
+)
+
+// CounterRejected counts the items rejected by the server, usually because the item does not exist
+const CounterRejected = "rejected"
+
+// Sender sends the check results by batches to Zabbix trapper items, with the Zabbix sender protocol
+type Sender struct {
+	counters       *shared.Counters
+	logger         *logrus.Logger
+	wg             sync.WaitGroup
+	queue          chan shared.CheckResult
+	done           chan struct{}
+	isShuttingDown uintptr
+	config         config.Zabbix
+	host           *template.Template
+	key            *template.Template
+	value          *template.Template
+}
+
+func execute(tpl *template.Template, checkResult shared.CheckResult) (string, error) {
+	var buf bytes.Buffer
+	err := tpl.Execute(&buf, checkResult)
+	return buf.String(), err
+}
+
+func (sender *Sender) newItem(checkResult shared.CheckResult) (it item, err error) {
+	if it.Host, err = execute(sender.host, checkResult); err != nil {
+		return
+	}
+	if it.Key, err = execute(sender.key, checkResult); err != nil {
+		return
+	}
+	if it.Value, err = execute(sender.value, checkResult); err != nil {
+		return
+	}
+	it.Clock = checkResult.Timestamp
+	if it.Clock == 0 {
+		it.Clock = uint64(time.Now().Unix())
+	}
+	return
+}
+
+func (sender *Sender) submit(packet []byte) (response, error) {
+	conn, err := net.DialTimeout("tcp", sender.config.Address, sender.config.Timeout)
+	if err != nil {
+		return response{}, shared.RetryableError{Err: err}
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(sender.config.Timeout))
+	if _, err := conn.Write(packet); err != nil {
+		return response{}, shared.RetryableError{Err: err}
+	}
+	resp, err := decode(conn)
+	if err != nil {
+		return response{}, shared.RetryableError{Err: err}
+	}
+	return resp, nil
+}
+
+func (sender *Sender) flush(batch []shared.CheckResult) {
+	items := make([]item, 0, len(batch))
+	for _, checkResult := range batch {
+		it, err := sender.newItem(checkResult)
+		if err != nil {
+			sender.logger.Error(err)
+			sender.counters.Add(shared.CounterFailed, 1)
+			continue
+		}
+		items = append(items, it)
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	packet, err := encode(senderData{
+		Request: "sender data",
+		Data:    items,
+		Clock:   time.Now().Unix(),
+	})
+	if err != nil {
+		sender.logger.Error(err)
+		sender.counters.Add(shared.CounterFailed, len(items))
+		return
+	}
+
+	var resp response
+	backoff := shared.Backoff{Retries: sender.config.Retries, Delay: sender.config.RetryDelay}
+	err = backoff.Retry(sender.logger, sender.counters, sender.done, func() (err error) {
+		resp, err = sender.submit(packet)
+		return
+	})
+	if err == nil {
+		rejected := resp.failed()
+		if rejected > 0 {
+			sender.logger.Warnf("Zabbix server rejected %d of %d items: %s", rejected, len(items), resp.Info)
+		}
+		sender.counters.Add(CounterRejected, rejected)
+		sender.counters.Add(shared.CounterSent, len(items)-rejected)
+		return
+	}
+
+	sender.counters.Add(shared.CounterFailed, len(items))
+	sender.logger.Errorf("Failed to send %d items to %s", len(items), sender.config.Address)
+}
+
+func (sender *Sender) spawnSender() {
+	sender.logger.Info("Spawning zabbix sender")
+	sender.wg.Add(1)
+	go func() {
+		ticker := time.NewTicker(sender.config.FlushInterval)
+		defer func() {
+			ticker.Stop()
+			sender.wg.Done()
+		}()
+		sender.logger.Info("Zabbix sender started")
+
+		batch := make([]shared.CheckResult, 0, sender.config.BatchSize)
+	loop:
+		for {
+			select {
+			case checkResult, ok := <-sender.queue:
+				if !ok {
+					break loop
+				}
+				batch = append(batch, checkResult)
+				if len(batch) < sender.config.BatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			sender.flush(batch)
+			batch = batch[:0]
+		}
+
+		if len(batch) > 0 {
+			sender.flush(batch)
+		}
+		sender.logger.Info("Zabbix sender ended")
+	}()
+}
+
+func (sender *Sender) Emit(checkResults []shared.CheckResult) error {
+	defer func() {
+		recover()
+	}()
+	for _, checkResult := range checkResults {
+		if sender.config.BlockQueue {
+			sender.queue <- checkResult
+			continue
+		}
+		select {
+		case sender.queue <- checkResult:
+		default:
+			sender.counters.Add(shared.CounterDropped, 1)
+			sender.logger.Warnf("Zabbix queue is full, dropping %s - %s", checkResult.Hostname, checkResult.ServiceName)
+		}
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the counters of the sender
+func (sender *Sender) Stats() map[string]uint64 {
+	return sender.counters.Snapshot()
+}
+
+func (sender *Sender) String() string {
+	return "zabbix"
+}
+
+func (sender *Sender) Stop() {
+	if atomic.CompareAndSwapUintptr(&sender.isShuttingDown, 0, 1) {
+		close(sender.queue)
+		close(sender.done)
+	}
+}
+
+func (sender *Sender) WaitForShutdown() {
+	sender.wg.Wait()
+}
+
+func (sender *Sender) Start() {
+	sender.spawnSender()
+}
+
+func NewSender(logger *logrus.Logger, _config config.Zabbix) (*Sender, error) {
+	host, err := template.New("host").Parse(_config.HostTemplate)
+	if err != nil {
+		return nil, err
+	}
+	key, err := template.New("key").Parse(_config.KeyTemplate)
+	if err != nil {
+		return nil, err
+	}
+	value, err := template.New("value").Parse(_config.ValueTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	sender := &Sender{
+		counters:       shared.NewCounters(shared.CounterSent, CounterRejected, shared.CounterFailed, shared.CounterDropped, shared.CounterRetries),
+		logger:         logger,
+		wg:             sync.WaitGroup{},
+		queue:          make(chan shared.CheckResult, _config.QueueSize),
+		done:           make(chan struct{}),
+		isShuttingDown: 0,
+		config:         _config,
+		host:           host,
+		key:            key,
+		value:          value,
+	}
+	return sender, nil
+}